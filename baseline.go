@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a baseline is a snapshot of the local tree taken right after a successful
+// sync, used to tell files changed locally since then apart from files that
+// merely differ because the remote moved ahead
+
+type fileState struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"` // unix nanoseconds
+}
+
+type baseline map[string]fileState // keyed by slash separated path relative to the local
+
+func baselinePath(local *Local) string {
+	// locals of different configs (profiles) may share names
+	return filepath.Join(stateDir(), "baseline", fmt.Sprintf("%s-%x.json", local.Name, hashString(configPath())))
+}
+
+func loadBaseline(local *Local) (baseline, error) {
+	data, err := os.ReadFile(baselinePath(local))
+	if err != nil {
+		return nil, err
+	}
+
+	var b baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline: %w", err)
+	}
+
+	return b, nil
+}
+
+func saveBaseline(local *Local, b baseline) error {
+	p := baselinePath(local)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// updateBaseline snapshots the given paths (or the whole local) after a
+// successful sync; partial updates need an existing full baseline to merge into
+func updateBaseline(cfg *Config, local *Local, paths []string) error {
+	if len(paths) == 0 {
+		b, err := snapshotLocal(local.Path, "", cfg.ExcludesForLocal(local))
+		if err != nil {
+			return err
+		}
+		return saveBaseline(local, b)
+	}
+
+	b, err := loadBaseline(local)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		for rel := range b {
+			if rel == p || strings.HasPrefix(rel, p+"/") {
+				delete(b, rel)
+			}
+		}
+
+		sub, err := snapshotLocal(local.Path, p, cfg.ExcludesForLocal(local))
+		if err != nil {
+			return err
+		}
+		for rel, state := range sub {
+			b[rel] = state
+		}
+	}
+
+	return saveBaseline(local, b)
+}
+
+// snapshotLocal records the state of every regular file under root/sub
+func snapshotLocal(root, sub string, excludes []string) (baseline, error) {
+	return snapshotTree(root, sub, excludes, false)
+}
+
+// snapshotTree is snapshotLocal that, with follow, records what symlinks
+// point to instead of skipping them, like rsync's --copy-links; dangling
+// links are left out, as rsync skips them too
+func snapshotTree(root, sub string, excludes []string, follow bool) (baseline, error) {
+	b := make(baseline)
+	visited := make(map[string]bool) // linked directories, in case of loops
+
+	var walk func(dir, prefix string) error
+	walk = func(dir, prefix string) error {
+		return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && p == dir {
+				return filepath.SkipAll
+			}
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			rel = path.Join(prefix, filepath.ToSlash(rel))
+			if rel == "." {
+				return nil
+			}
+
+			linked := false
+			if follow && d.Type()&fs.ModeSymlink != 0 {
+				info, err := os.Stat(p)
+				if err != nil {
+					return nil
+				}
+				d, linked = fs.FileInfoToDirEntry(info), true
+			}
+			if isExcluded(rel, d.IsDir(), excludes) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if linked && d.IsDir() {
+				real, err := filepath.EvalSymlinks(p)
+				if err != nil || visited[real] {
+					return nil
+				}
+				visited[real] = true
+				// a trailing separator makes the walk start at the target
+				return walk(p+string(filepath.Separator), rel)
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			b[rel] = stateOf(info)
+
+			return nil
+		})
+	}
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		visited[real] = true
+	}
+	err := walk(filepath.Join(root, filepath.FromSlash(sub)), sub)
+
+	return b, err
+}
+
+func stateOf(info fs.FileInfo) fileState {
+	return fileState{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// isExcluded approximates rsync's exclude matching: patterns with a trailing
+// slash only match directories, patterns containing a slash are matched
+// against the whole path (anchored if they start with one) and all others
+// against the last path element
+func isExcluded(rel string, isDir bool, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		var matched bool
+		if strings.Contains(pattern, "/") {
+			matched, _ = path.Match(strings.TrimPrefix(pattern, "/"), rel)
+			if !matched && !strings.HasPrefix(pattern, "/") {
+				matched, _ = path.Match("*/"+pattern, rel)
+			}
+		} else {
+			matched, _ = path.Match(pattern, path.Base(rel))
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// localModified reports whether the local file at rel differs from its state
+// in the baseline, including files created or deleted since
+func (b baseline) localModified(root, rel string) bool {
+	info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(rel)))
+	state, known := b[rel]
+	if err != nil {
+		return known
+	}
+
+	return !known || stateOf(info) != state
+}
+
+// knownPath reports whether rel is a file or directory in the baseline
+func (b baseline) knownPath(rel string) bool {
+	if _, ok := b[rel]; ok {
+		return true
+	}
+	prefix := rel + "/"
+	for p := range b {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findPushConflicts returns the remote changes a push would overwrite; remote
+// files missing locally are left out if they were deleted here since the last
+// sync and their remote copy is still the synced one, since pushing the
+// deletion is what's intended. encrypted locals can't tell, their remote
+// names and sizes differ. pushes of append-only locals never delete, so
+// nothing that only exists on the remote is in their way
+func findPushConflicts(cfg *Config, local *Local, changes []string) ([]string, error) {
+	if !local.deletes() {
+		var conflicts []string
+		for _, c := range changes {
+			if !isNewItem(c) {
+				conflicts = append(conflicts, c)
+			}
+		}
+		return conflicts, nil
+	}
+
+	b, err := loadBaseline(local)
+	if errors.Is(err, fs.ErrNotExist) || local.Encrypt {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, c := range changes {
+		rel := changePath(c)
+		if _, known := b[rel]; !known || !isNewItem(c) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(local.Path, filepath.FromSlash(rel))); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, rel)
+		}
+	}
+	if len(missing) == 0 {
+		return changes, nil
+	}
+
+	states, err := statRemote(cfg, local.RemoteDir(), missing)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]bool)
+	for _, rel := range missing {
+		if remote, ok := states[rel]; ok && sameState(remote, b[rel]) {
+			deleted[rel] = true
+		}
+	}
+
+	return withoutDeleted(changes, deleted), nil
+}
+
+// sameState compares the state of a remote file with a local one, at the
+// second precision of the remote side
+func sameState(remote, local fileState) bool {
+	return remote.Size == local.Size && remote.ModTime/int64(time.Second) == local.ModTime/int64(time.Second)
+}
+
+// withoutDeleted drops the changes of deleted files, and of new directories
+// that are only there because of them
+func withoutDeleted(changes []string, deleted map[string]bool) []string {
+	var files []string
+	for _, c := range changes {
+		if !deleted[changePath(c)] {
+			files = append(files, c)
+		}
+	}
+
+	var kept []string
+	for _, c := range files {
+		dir := changePath(c)
+		if isNewItem(c) && strings.HasSuffix(dir, "/") && !fileChangeUnder(files, dir) && deletedUnder(deleted, dir) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+
+	return kept
+}
+
+func fileChangeUnder(changes []string, dir string) bool {
+	for _, c := range changes {
+		if p := changePath(c); strings.HasPrefix(p, dir) && !strings.HasSuffix(p, "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func deletedUnder(deleted map[string]bool, dir string) bool {
+	for p := range deleted {
+		if strings.HasPrefix(p, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findPullConflicts returns the changes of a pull plan that would overwrite or
+// delete local modifications; with a baseline these are files changed locally
+// since the last sync, without one it falls back to files newer locally than
+// on the remote, plus every deletion since their origin can't be told
+func findPullConflicts(cfg *Config, local *Local, rsyncOpts rsyncOptions, changes []string) ([]string, error) {
+	var conflicts []string
+
+	b, err := loadBaseline(local)
+	if err == nil {
+		for _, c := range changes {
+			rel := changePath(c)
+			if isDestructive(c) && !strings.HasSuffix(rel, "/") && b.localModified(local.Path, rel) {
+				conflicts = append(conflicts, c)
+			}
+		}
+		return conflicts, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// files --update would skip are the ones newer on this side
+	rsyncOpts.Update = true
+	updated, err := planTransfer(cfg.RemoteForLocal(local), transferRoot(local), rsyncOpts)
+	if err != nil {
+		return nil, err
+	}
+	notNewer := make(map[string]bool, len(updated))
+	for _, c := range updated {
+		notNewer[changePath(c)] = true
+	}
+
+	for _, c := range changes {
+		rel := changePath(c)
+		if !isDestructive(c) || strings.HasSuffix(rel, "/") {
+			continue
+		}
+		if isDeletion(c) || !notNewer[rel] {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	return conflicts, nil
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -36,27 +45,32 @@ func cmdInit(remote string) error {
 		return err
 	}
 
-	fmt.Printf("[+] initialized gs with remote %s:%s\n", cfg.Server, cfg.RemotePath)
-	fmt.Printf("[+] config saved to %s\n", configPath())
-	fmt.Println("[+] run 'gs track' in directories you want to sync")
+	logSuccess("initialized gs with remote %s:%s", cfg.Server, cfg.RemotePath)
+	logSuccess("config saved to %s", configPath())
+	logSuccess("run 'gs track' in directories you want to sync")
 
 	return nil
 }
 
-func cmdTrack() error {
+func cmdTrack(dir, name, remoteSubdir string) error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return fmt.Errorf("no config found (run 'gs init' first)")
 	}
 
-	cwd, err := os.Getwd()
+	path, err := resolveDir(dir)
 	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
+		return err
 	}
 
-	localName := filepath.Base(cwd)
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	if remoteSubdir == name {
+		remoteSubdir = ""
+	}
 
-	if err := cfg.AddLocal(localName, cwd); err != nil {
+	if err := cfg.addLocal(Local{Name: name, Path: path, RemoteSubdir: remoteSubdir}); err != nil {
 		return err
 	}
 
@@ -64,220 +78,1346 @@ func cmdTrack() error {
 		return err
 	}
 
-	fmt.Printf("[+] tracking '%s' (%s) -> %s\n", localName, cwd, cfg.RemoteForLocal(cfg.FindLocalByName(localName)))
+	logSuccess("tracking '%s' (%s) -> %s", name, path, cfg.RemoteForLocal(cfg.FindLocalByName(name)))
+	updateDeviceRegistration(cfg)
 
 	return nil
 }
 
-func cmdUntrack() error {
+type untrackOptions struct {
+	PurgeRemote bool
+	DryRun      bool
+	Yes         bool
+	Force       bool
+}
+
+func cmdUntrack(dir string, opts untrackOptions) error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return fmt.Errorf("no config found")
 	}
 
-	cwd, err := os.Getwd()
+	// the directory may already be gone, so it isn't required to exist
+	path, err := os.Getwd()
+	if dir != "" {
+		path, err = filepath.Abs(expandPath(dir))
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
+		return fmt.Errorf("failed to resolve directory: %w", err)
 	}
 
-	local := cfg.FindLocalForPath(cwd)
+	local := cfg.FindLocalForPath(path)
 	if local == nil {
-		return fmt.Errorf("current directory is not tracked")
+		return fmt.Errorf("'%s' is not tracked", path)
+	}
+
+	name, remoteDir := local.Name, local.RemoteDir()
+	remote := cfg.RemoteForLocal(local)
+
+	if opts.PurgeRemote {
+		if err := purgeRemote(cfg, remoteDir, remote, opts); err != nil {
+			return err
+		}
+	}
+	if opts.DryRun {
+		logSuccess("dry run, '%s' is still tracked", name)
+		return nil
 	}
 
-	name := local.Name
 	cfg.RemoveLocal(name)
 
 	if err := saveConfig(cfg); err != nil {
 		return err
 	}
+	for _, p := range localStatePaths(&Local{Name: name}) {
+		os.RemoveAll(p)
+	}
 
-	fmt.Printf("[+] untracked '%s'\n", name)
+	logSuccess("untracked '%s'", name)
+	updateDeviceRegistration(cfg)
 
 	return nil
 }
 
-func getCurrentLocal(cfg *Config) (*Local, error) {
-	cwd, err := os.Getwd()
+func purgeRemote(cfg *Config, remoteDir, remote string, opts untrackOptions) error {
+	devices, err := remoteDevices(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get current directory: %w", err)
+		return err
+	}
+	if others := devicesTracking(cfg, devices, remoteDir); len(others) > 0 {
+		logWarn("%s is still tracked by: %s", remote, strings.Join(others, ", "))
+		if !opts.Force {
+			return fmt.Errorf("refusing to purge remote data used by other devices (use --force to purge anyway)")
+		}
 	}
 
-	local := cfg.FindLocalForPath(cwd)
-	if local == nil {
-		return nil, fmt.Errorf("current directory is not a configured local (run 'gs track' first)")
+	files, err := listRemoteFiles(cfg, remoteDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		logProgress("%s does not exist or is empty", remote)
+	} else {
+		logWarn("the following would be deleted from %s:", remote)
+		for _, f := range files {
+			fmt.Printf("  %s\n", f)
+		}
 	}
 
-	return local, nil
+	if opts.DryRun {
+		return nil
+	}
+	if !opts.Yes && !confirm(fmt.Sprintf("delete %s and untrack it?", remote), false) {
+		return fmt.Errorf("untrack aborted")
+	}
+
+	if err := removeRemoteDir(cfg, remoteDir); err != nil {
+		return fmt.Errorf("failed to purge remote: %w", err)
+	}
+	logSuccess("deleted %s", remote)
+
+	return nil
 }
 
-func cmdPush(force bool) error {
+type pruneAction int
+
+const (
+	pruneAsk pruneAction = iota
+	pruneArchive
+	pruneDelete
+)
+
+func cmdRemotePrune(action pruneAction, dryRun bool) error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	local, err := getCurrentLocal(cfg)
-	if err != nil {
+	// make sure this device's view is current before judging others
+	if err := registerDevice(cfg, true); err != nil {
 		return err
 	}
-	remote := cfg.RemoteForLocal(local)
 
-	fmt.Println("[~] checking for remote changes...")
-	changes, err := checkRemoteChanges(cfg, local)
+	devices, err := remoteDevices(cfg)
 	if err != nil {
-		if !errors.Is(err, ErrRemoteNotFound) {
-			return fmt.Errorf("failed to check remote: %w", err)
-		}
+		return err
+	}
+	dirs, err := listRemoteDirs(cfg)
+	if err != nil {
+		return err
 	}
 
-	if len(changes) > 0 {
-		fmt.Println("[!] remote has changes that would be overwritten:")
-		for _, c := range changes {
-			fmt.Printf("  %s\n", c)
+	deviceNames := slices.Sorted(maps.Keys(devices))
+	logProgress("registered devices: %s", strings.Join(deviceNames, ", "))
+
+	orphans := findOrphans(dirs, devices)
+	if len(orphans) == 0 {
+		logSuccess("no orphaned remote directories")
+		return nil
+	}
+
+	logWarn("remote directories not tracked by any device:")
+	for _, o := range orphans {
+		fmt.Printf("  %s (%s, %d files)\n", o.Name, formatSize(o.Size), o.Files)
+	}
+	if dryRun {
+		return nil
+	}
+
+	now := time.Now()
+	for _, o := range orphans {
+		a := action
+		if a == pruneAsk {
+			a = askPruneAction(o.Name)
 		}
-		if !force {
-			fmt.Println("[+] run 'gs pull' first, or use 'gs push --force' to overwrite")
-			return fmt.Errorf("push aborted: remote has unpulled changes")
+
+		switch a {
+		case pruneArchive:
+			dst := archiveName(o.Name, now)
+			if _, err := moveRemoteDir(cfg, o.Name, dst); err != nil {
+				return err
+			}
+			logSuccess("archived '%s' to %s", o.Name, cfg.remoteDirPath(dst))
+		case pruneDelete:
+			if err := removeRemoteDir(cfg, o.Name); err != nil {
+				return err
+			}
+			logSuccess("deleted '%s'", o.Name)
+		default:
+			logProgress("skipped '%s'", o.Name)
 		}
-		fmt.Println("[!] --force specified, proceeding anyway...")
 	}
 
-	fmt.Printf("[~] pushing '%s' to server...\n", local.Name)
-	result, err := runRsync(local.Path, remote, cfg.Port, cfg.Excludes, false, true)
+	return nil
+}
+
+func askPruneAction(name string) pruneAction {
+	fmt.Printf("[?] '%s': [a]rchive, [d]elete or [s]kip? [s] ", name)
+
+	answer, err := stdin.ReadString('\n')
 	if err != nil {
-		return err
+		fmt.Println()
+		return pruneAsk
 	}
 
-	fmt.Print(result.Output)
-	fmt.Println("[+] push complete")
-
-	return nil
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "a", "archive":
+		return pruneArchive
+	case "d", "delete":
+		return pruneDelete
+	default:
+		return pruneAsk
+	}
 }
 
-func cmdPull() error {
+// cmdRename renames a local, moving its remote directory along unless it's
+// kept or set explicitly; remoteSubdir moves it to that directory instead,
+// also without renaming the local if newName is the old one
+func cmdRename(oldName, newName, remoteSubdir string, keepRemote, force bool) error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	local, err := getCurrentLocal(cfg)
-	if err != nil {
+	local := cfg.FindLocalByName(oldName)
+	if local == nil {
+		return fmt.Errorf("no local named '%s'", oldName)
+	}
+	if newName == oldName && remoteSubdir == "" {
+		return fmt.Errorf("local is already named '%s'", newName)
+	}
+	if newName != oldName && cfg.FindLocalByName(newName) != nil {
+		return fmt.Errorf("local '%s' already exists", newName)
+	}
+
+	oldRemote := local.RemoteDir()
+	local.Name = newName
+	switch {
+	case remoteSubdir != "":
+		local.RemoteSubdir = remoteSubdir
+	case keepRemote:
+		local.RemoteSubdir = oldRemote
+	case local.RemoteSubdir != "":
+		// an explicitly configured remote directory doesn't follow the name
+		logProgress("remote directory is set explicitly to '%s', leaving it as is (use --remote-subdir to move it)", oldRemote)
+	}
+	if local.RemoteSubdir == local.Name {
+		local.RemoteSubdir = ""
+	}
+	newRemote := local.RemoteDir()
+
+	if err := validateConfig(cfg); err != nil {
 		return err
 	}
-	remote := cfg.RemoteForLocal(local)
 
-	fmt.Printf("[~] pulling '%s' from server...\n", local.Name)
-	result, err := runRsync(remote, local.Path, cfg.Port, cfg.Excludes, false, true)
-	if err != nil {
+	moved := false
+	if newRemote != oldRemote {
+		// other devices would keep pushing to the old directory
+		devices, err := remoteDevices(cfg)
+		if err != nil {
+			return err
+		}
+		if others := devicesTracking(cfg, devices, oldRemote); len(others) > 0 {
+			logWarn("%s is still tracked by: %s", cfg.remoteDirPath(oldRemote), strings.Join(others, ", "))
+			if !force {
+				logSuccess("use --keep-remote to only rename the local")
+				return fmt.Errorf("refusing to move remote data used by other devices (use --force to move it anyway)")
+			}
+		}
+
+		logProgress("moving %s to %s on server...", cfg.remoteDirPath(oldRemote), cfg.remoteDirPath(newRemote))
+		moved, err = moveRemoteDir(cfg, oldRemote, newRemote)
+		if err != nil {
+			return err
+		}
+		if !moved {
+			logProgress("nothing to move, remote directory does not exist yet")
+		}
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		if moved {
+			if _, undoErr := moveRemoteDir(cfg, newRemote, oldRemote); undoErr != nil {
+				logError("failed to move remote directory back: %s", undoErr)
+			}
+		}
 		return err
 	}
 
-	fmt.Print(result.Output)
-	fmt.Println("[+] pull complete")
+	logSuccess("renamed '%s' to '%s' -> %s", oldName, newName, cfg.RemoteForLocal(local))
+	if newName != oldName {
+		renameLocalState(oldName, local)
+	}
+	if err := registerDevice(cfg, false); err != nil {
+		logWarn("%s", err)
+	}
 
 	return nil
 }
 
-func cmdStatus() error {
+// localStatePaths returns the files and directories of the state kept per
+// local name, except for the history
+func localStatePaths(local *Local) []string {
+	return []string{
+		baselinePath(local),
+		stagingDir(local),
+		manifestPath(local),
+		pendingPath(local),
+		totalsPath(local),
+		hashCachePath(local, "local"),
+		hashCachePath(local, "remote"),
+	}
+}
+
+// renameLocalState moves the state kept per local name along with a rename
+func renameLocalState(oldName string, local *Local) {
+	newPaths := localStatePaths(local)
+	for i, p := range localStatePaths(&Local{Name: oldName}) {
+		os.Rename(p, newPaths[i])
+	}
+
+	if err := renameHistory(oldName, local.Name); err != nil {
+		logWarn("failed to update history: %s", err)
+	}
+}
+
+func cmdRelocate(name, dir string) error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	local, err := getCurrentLocal(cfg)
+	local := cfg.FindLocalByName(name)
+	if local == nil {
+		return fmt.Errorf("no local named '%s'", name)
+	}
+
+	path, err := resolveDir(dir)
 	if err != nil {
 		return err
 	}
-	remote := cfg.RemoteForLocal(local)
 
-	fmt.Printf("[~] checking status for '%s'...\n", local.Name)
+	oldPath := local.Path
+	local.Path = path
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
 
-	fmt.Println("[~] checking remote...")
-	pullResult, err := runRsync(remote, local.Path, cfg.Port, cfg.Excludes, true, true)
-	if errors.Is(err, ErrRemoteNotFound) {
-		fmt.Println("[!] remote directory does not exist yet")
-		fmt.Println("[+] run 'gs push' to initialize it")
-		return nil
+	if err := saveConfig(cfg); err != nil {
+		return err
 	}
+
+	logSuccess("relocated '%s' from %s to %s", name, oldPath, path)
+
+	return nil
+}
+
+// resolveDir returns the absolute path of an existing directory, defaulting
+// to the current directory
+func resolveDir(dir string) (string, error) {
+	if dir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get current directory: %w", err)
+		}
+		return cwd, nil
+	}
+
+	path, err := filepath.Abs(expandPath(dir))
 	if err != nil {
-		return fmt.Errorf("failed to check remote: %w", err)
+		return "", fmt.Errorf("failed to resolve '%s': %w", dir, err)
 	}
 
-	fmt.Println("[~] checking local...")
-	pushResult, err := runRsync(local.Path, remote, cfg.Port, cfg.Excludes, true, true)
+	info, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("failed to check local changes: %w", err)
+		return "", fmt.Errorf("failed to access '%s': %w", path, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("'%s' is not a directory", path)
 	}
 
-	if len(pushResult.Changes) == 0 && len(pullResult.Changes) == 0 {
-		fmt.Println("[+] everything is in sync")
-		return nil
+	return path, nil
+}
+
+func getCurrentLocal(cfg *Config) (*Local, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	if len(pushResult.Changes) > 0 {
-		fmt.Println("[+] local changes (push to sync):")
-		for _, c := range pushResult.Changes {
-			fmt.Printf("  %s\n", c)
+	local := cfg.FindLocalForPath(cwd)
+	if local == nil {
+		return nil, fmt.Errorf("current directory is not a configured local (run 'gs track' first)")
+	}
+
+	return local, nil
+}
+
+// resolveLocalPaths maps path arguments to paths relative to the local's root,
+// returning nil if one of them is the root itself
+func resolveLocalPaths(local *Local, args []string, mustExist bool) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		abs, err := filepath.Abs(expandPath(arg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve '%s': %w", arg, err)
+		}
+
+		rel, err := filepath.Rel(local.Path, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("'%s' is outside of local '%s' (%s)", arg, local.Name, local.Path)
 		}
+		if rel == "." {
+			return nil, nil
+		}
+
+		if mustExist {
+			if _, err := os.Lstat(abs); err != nil {
+				return nil, fmt.Errorf("failed to access '%s': %w", arg, err)
+			}
+		}
+		paths = append(paths, filepath.ToSlash(rel))
 	}
 
-	if len(pullResult.Changes) > 0 {
-		fmt.Println("[+] remote changes (pull to sync):")
-		for _, c := range pullResult.Changes {
-			fmt.Printf("  %s\n", c)
+	return paths, nil
+}
+
+func describePaths(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s)", strings.Join(paths, ", "))
+}
+
+type syncOptions struct {
+	Paths    []string // relative to the local's root, all of it if empty
+	Force    bool
+	DryRun   bool   // only print what would be transferred
+	Confirm  bool   // show the plan and ask before destructive changes
+	Checksum bool   // compare file contents instead of size and modification time
+	Verify   bool   // compare hashes of both sides after the transfer
+	BwLimit  string // overrides the configured bandwidth limit
+
+	Report *syncReport // filled with the outcome if set
+}
+
+// syncReport is the outcome of a push or pull, printed with '--json'
+type syncReport struct {
+	Command    string         `json:"command"`
+	Local      string         `json:"local,omitempty"`
+	Paths      []string       `json:"paths,omitempty"`
+	DryRun     bool           `json:"dry_run,omitempty"`
+	Started    time.Time      `json:"started"`
+	Changes    []string       `json:"changes"`
+	Stats      transferStats  `json:"stats"`
+	Verified   *bool          `json:"verified,omitempty"` // set only if the transfer was verified
+	Mismatches []hashMismatch `json:"mismatches,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type transferStats struct {
+	Files         int   `json:"files"` // regular files transferred
+	Deleted       int   `json:"deleted"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+func statsOf(result *RsyncResult) transferStats {
+	stats := transferStats{
+		Files:         result.Stats.FilesTransferred,
+		BytesSent:     result.Stats.BytesSent,
+		BytesReceived: result.Stats.BytesReceived,
+	}
+	for _, c := range result.Changes {
+		if isDeletion(c) {
+			stats.Deleted++
 		}
 	}
 
-	return nil
+	return stats
 }
 
-func pullLocal(cfg *Config, local *Local) error {
-	remote := cfg.RemoteForLocal(local)
+// newReport returns the report to fill for opts, a throwaway one if the
+// caller doesn't want it
+func newReport(opts syncOptions, command string, local *Local) *syncReport {
+	report := opts.Report
+	if report == nil {
+		report = &syncReport{}
+	}
+	report.Command = command
+	report.Local = local.Name
+	report.Paths = opts.Paths
+	report.DryRun = opts.DryRun
+	report.Started = time.Now()
+	report.Changes = []string{}
+
+	return report
+}
+
+func describeChanges(changes []string) []string {
+	described := make([]string, 0, len(changes))
+	for _, c := range changes {
+		described = append(described, describeChange(c))
+	}
+
+	return described
+}
 
-	fmt.Printf("[~] pulling '%s' from server...\n", local.Name)
-	result, err := runRsync(remote, local.Path, cfg.Port, cfg.Excludes, false, true)
+func planTransfer(src, dst string, rsyncOpts rsyncOptions) ([]string, error) {
+	rsyncOpts.DryRun = true
+	plan, err := runRsync(src, dst, rsyncOpts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Print(result.Output)
-	fmt.Printf("[+] pull complete for '%s'\n", local.Name)
+	return plan.Changes, nil
+}
 
-	return nil
+// confirmPlan shows the changes a transfer would make, returning false if
+// nothing should be transferred (dry run, nothing to do or user declined)
+func confirmPlan(changes []string, direction string, local *Local, opts syncOptions) (bool, error) {
+	if len(changes) == 0 {
+		logSuccess("nothing to %s", direction)
+		return false, nil
+	}
+
+	destructive := 0
+	logSuccess("%s plan for '%s' (%d changes):", direction, local.Name, len(changes))
+	for _, c := range changes {
+		fmt.Printf("  %s\n", describeChange(c))
+		if isDestructive(c) {
+			destructive++
+		}
+	}
+
+	if opts.DryRun {
+		logSuccess("dry run, nothing was transferred")
+		return false, nil
+	}
+	if opts.Confirm && destructive > 0 {
+		if !confirm(fmt.Sprintf("%d existing file(s) will be overwritten or deleted, continue?", destructive), false) {
+			return false, fmt.Errorf("%s aborted", direction)
+		}
+	}
+
+	return true, nil
+}
+
+var (
+	ErrRemoteChanged    = errors.New("remote has unpulled changes")
+	ErrLocalChanged     = errors.New("local has unpushed changes")
+	ErrTooManyDeletions = errors.New("too many deletions")
+)
+
+// checkDeletions blocks transfers deleting more than max_deletions files,
+// which usually means the wrong directory was synced or one side got wiped
+func checkDeletions(cfg *Config, changes []string, direction string) error {
+	if cfg.MaxDeletions == 0 {
+		return nil
+	}
+
+	deletions := 0
+	for _, c := range changes {
+		if isDeletion(c) {
+			deletions++
+		}
+	}
+	if deletions <= cfg.MaxDeletions {
+		return nil
+	}
+
+	logWarn("%s would delete %d files, more than max_deletions (%d)", direction, deletions, cfg.MaxDeletions)
+	logSuccess("check them with 'gs %s --dry-run', then use --confirm or --force to continue", direction)
+
+	return fmt.Errorf("%s aborted: %w", direction, ErrTooManyDeletions)
 }
 
-func cmdAuto(interval, timeout time.Duration) error {
+// finishSync records the outcome of a push or pull and reports it
+func finishSync(cfg *Config, local *Local, report *syncReport, err error) {
+	if report.DryRun {
+		return
+	}
+
+	recordHistory(report, err)
+	if err == nil && len(report.Paths) == 0 {
+		if report.Command == "push" {
+			recordPending(local, 0, -1)
+		} else {
+			recordPending(local, -1, 0)
+		}
+	}
+	updateMetricsFile(cfg)
+	notifyResult(cfg, report, err)
+}
+
+func cmdPush(args []string, opts syncOptions) error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	if len(cfg.Locals) == 0 {
-		return fmt.Errorf("no locals configured")
+	local, err := getCurrentLocal(cfg)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("[~] waiting for server %s:%s...\n", cfg.Server, cfg.Port)
-	if err := waitForServer(cfg.Server, cfg.Port, interval, timeout); err != nil {
+	opts.Paths, err = resolveLocalPaths(local, args, false)
+	if err != nil {
+		return err
+	}
+	if err := checkPushPaths(cfg, local, opts.Paths); err != nil {
+		return err
+	}
+
+	return pushLocal(cfg, local, opts)
+}
+
+// checkPushPaths makes sure paths missing locally were deleted since they
+// were synced rather than mistyped, as pushing them deletes them on the remote
+func checkPushPaths(cfg *Config, local *Local, paths []string) error {
+	b, err := loadBaseline(local)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var unknown []string
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(local.Path, filepath.FromSlash(p))); err == nil || b.knownPath(p) {
+			continue
+		}
+		unknown = append(unknown, p)
+	}
+	// encrypted names can't be looked up on the remote
+	if len(unknown) > 0 && !local.Encrypt {
+		states, err := statRemote(cfg, local.RemoteDir(), unknown)
+		if err != nil && !errors.Is(err, ErrRemoteNotFound) {
+			return fmt.Errorf("failed to check remote: %w", err)
+		}
+		unknown = slices.DeleteFunc(unknown, baseline(states).knownPath)
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("'%s' doesn't exist locally or on the remote", unknown[0])
+	}
+
+	return nil
+}
+
+// cmdPushAll pushes every local whose mode allows it
+func cmdPushAll(opts syncOptions) error {
+	cfg, err := loadConfig()
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[~] server is reachable, pulling %d local(s)...\n", len(cfg.Locals))
+	if len(cfg.Locals) == 0 {
+		return fmt.Errorf("no locals configured")
+	}
 
-	var failed []string
+	var locals []*Local
 	for i := range cfg.Locals {
-		if err := pullLocal(cfg, &cfg.Locals[i]); err != nil {
-			fmt.Printf("[!] failed to pull '%s': %s\n", cfg.Locals[i].Name, err)
-			failed = append(failed, cfg.Locals[i].Name)
+		if local := &cfg.Locals[i]; local.pushes() {
+			locals = append(locals, local)
+		} else {
+			logProgress("skipping '%s' (mode '%s')", local.Name, local.mode())
 		}
 	}
 
+	failed := syncMetered(cfg, locals, "push", defaultInterval, defaultTimeout, func(local *Local) error {
+		return pushLocal(cfg, local, opts)
+	})
+
 	if len(failed) > 0 {
-		return fmt.Errorf("failed to pull: %v", failed)
+		return fmt.Errorf("failed to push: %v", failed)
 	}
 
-	fmt.Println("[+] auto-pull complete for all locals")
-
 	return nil
 }
 
+func pushLocal(cfg *Config, local *Local, opts syncOptions) (err error) {
+	if err := local.allows("push"); err != nil {
+		return err
+	}
+	remote := cfg.RemoteForLocal(local)
+	defer logScope("operation", "push", "local", local.Name, "remote", remote)()
+	report := newReport(opts, "push", local)
+	defer func() { finishSync(cfg, local, report, err) }()
+	if err := runHooks(cfg, local, "pre_push", report); err != nil {
+		return fmt.Errorf("push aborted: %w", err)
+	}
+	if local.Git {
+		if err := checkGitPush(local); err != nil {
+			return err
+		}
+	}
+	root, err := syncRoot(cfg, local)
+	if err != nil {
+		return err
+	}
+
+	logProgress("checking for remote changes...")
+	changes, err := checkRemoteChanges(cfg, local, opts)
+	remoteMissing := errors.Is(err, ErrRemoteNotFound)
+	if err != nil && !remoteMissing {
+		return fmt.Errorf("failed to check remote: %w", err)
+	}
+	if len(changes) > 0 {
+		if changes, err = findPushConflicts(cfg, local, changes); err != nil {
+			return fmt.Errorf("failed to check remote: %w", err)
+		}
+	}
+
+	if len(changes) > 0 {
+		logWarn("remote has changes that would be overwritten:")
+		for _, c := range changes {
+			fmt.Printf("  %s\n", c)
+		}
+		switch {
+		case !local.pulls():
+			logWarn("'%s' has mode '%s', proceeding anyway...", local.Name, local.mode())
+		case !opts.Force:
+			logSuccess("run 'gs pull' first, or use 'gs push --force' to overwrite")
+			return fmt.Errorf("push aborted: %w", ErrRemoteChanged)
+		default:
+			logWarn("--force specified, proceeding anyway...")
+		}
+	}
+
+	rsyncOpts := cfg.rsyncOptions(local)
+	rsyncOpts.Delete = local.deletes()
+	rsyncOpts.Paths = opts.Paths
+	rsyncOpts.MissingPaths = true
+	rsyncOpts.Checksum = rsyncOpts.Checksum || opts.Checksum
+	if opts.BwLimit != "" {
+		rsyncOpts.BwLimit = opts.BwLimit
+	}
+
+	// a dry run against a missing remote directory would fail, and there's
+	// nothing to overwrite there anyway
+	guarded := cfg.MaxDeletions > 0 && !opts.Force
+	if (opts.DryRun || opts.Confirm || guarded) && !remoteMissing {
+		changes, err := planTransfer(root, remote, rsyncOpts)
+		if err != nil {
+			return err
+		}
+		report.Changes = describeChanges(changes)
+		if opts.DryRun || opts.Confirm {
+			proceed, err := confirmPlan(changes, "push", local, opts)
+			if err != nil || !proceed {
+				return err
+			}
+		} else if err := checkDeletions(cfg, changes, "push"); err != nil {
+			return err
+		}
+	} else if opts.DryRun {
+		logSuccess("remote directory does not exist yet, push would upload everything")
+		return nil
+	}
+
+	if remoteMissing {
+		if err := makeRemoteParent(cfg, local.RemoteDir()); err != nil {
+			return fmt.Errorf("failed to create remote directory: %w", err)
+		}
+	}
+
+	logProgress("pushing '%s'%s to server...", local.Name, describePaths(opts.Paths))
+	rsyncOpts.Live = true
+	rsyncOpts.Stats = true
+	result, err := runRsync(root, remote, rsyncOpts)
+	if err != nil {
+		return err
+	}
+	report.Changes = describeChanges(result.Changes)
+	report.Stats = statsOf(result)
+
+	logSuccess("push complete for '%s'", local.Name)
+	if err := updateBaseline(cfg, local, opts.Paths); err != nil {
+		logWarn("failed to update baseline: %s", err)
+	}
+	if err := registerDevice(cfg, false); err != nil {
+		logWarn("%s", err)
+	}
+
+	if err := checkTransfer(cfg, local, opts, report); err != nil {
+		return err
+	}
+
+	return runHooks(cfg, local, "post_push", report)
+}
+
+func cmdPull(args []string, opts syncOptions) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	local, err := getCurrentLocal(cfg)
+	if err != nil {
+		return err
+	}
+
+	opts.Paths, err = resolveLocalPaths(local, args, false)
+	if err != nil {
+		return err
+	}
+
+	if err := pullLocal(cfg, local, opts); err != nil {
+		return err
+	}
+
+	if err := registerDevice(cfg, false); err != nil {
+		logWarn("%s", err)
+	}
+
+	return nil
+}
+
+// statusChanges returns the dry run changes in both directions, limited to
+// the paths in syncOpts if any are given
+func statusChanges(cfg *Config, local *Local, syncOpts syncOptions) (push, pull []string, err error) {
+	root, err := syncRoot(cfg, local)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := cfg.RemoteForLocal(local)
+	opts := cfg.rsyncOptions(local)
+	opts.Delete = local.deletes()
+	opts.Paths = syncOpts.Paths
+	opts.Checksum = opts.Checksum || syncOpts.Checksum
+
+	logProgress("checking remote...")
+	pull, err = planTransfer(remote, root, opts)
+	if errors.Is(err, ErrRemoteNotFound) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check remote: %w", err)
+	}
+
+	logProgress("checking local...")
+	push, err = planTransfer(root, remote, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check local changes: %w", err)
+	}
+
+	return push, pull, nil
+}
+
+func cmdStatus(opts syncOptions) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	local, err := getCurrentLocal(cfg)
+	if err != nil {
+		return err
+	}
+
+	logProgress("checking status for '%s'...", local.Name)
+
+	pushChanges, pullChanges, err := statusChanges(cfg, local, opts)
+	if errors.Is(err, ErrRemoteNotFound) {
+		logWarn("remote directory does not exist yet")
+		logSuccess("run 'gs push' to initialize it")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pushChanges, pullChanges = local.syncedChanges(pushChanges, pullChanges)
+	if len(opts.Paths) == 0 {
+		recordPending(local, len(pushChanges), len(pullChanges))
+		updateMetricsFile(cfg)
+	}
+	if local.Symlinks != symlinksSkip {
+		warnUnsafeLinks(cfg, local)
+	}
+	if err := warnLargeFiles(cfg, local, opts); err != nil {
+		logWarn("failed to check file sizes: %s", err)
+	}
+
+	if len(pushChanges) == 0 && len(pullChanges) == 0 {
+		logSuccess("everything is in sync")
+		return nil
+	}
+
+	if len(pushChanges) > 0 {
+		logSuccess("local changes (push to sync):")
+		for _, c := range pushChanges {
+			fmt.Printf("  %s\n", c)
+		}
+	}
+
+	if len(pullChanges) > 0 {
+		logSuccess("remote changes (pull to sync):")
+		for _, c := range pullChanges {
+			fmt.Printf("  %s\n", c)
+		}
+	}
+
+	return nil
+}
+
+func pullLocal(cfg *Config, local *Local, opts syncOptions) (err error) {
+	if err := local.allows("pull"); err != nil {
+		return err
+	}
+	remote := cfg.RemoteForLocal(local)
+	defer logScope("operation", "pull", "local", local.Name, "remote", remote)()
+	report := newReport(opts, "pull", local)
+	defer func() { finishSync(cfg, local, report, err) }()
+	if err := runHooks(cfg, local, "pre_pull", report); err != nil {
+		return fmt.Errorf("pull aborted: %w", err)
+	}
+	root, err := syncRoot(cfg, local)
+	if err != nil {
+		return err
+	}
+
+	rsyncOpts := cfg.rsyncOptions(local)
+	rsyncOpts.Delete = local.deletes()
+	rsyncOpts.Paths = opts.Paths
+	rsyncOpts.Checksum = rsyncOpts.Checksum || opts.Checksum
+	if opts.BwLimit != "" {
+		rsyncOpts.BwLimit = opts.BwLimit
+	}
+
+	if !opts.Force || opts.DryRun || opts.Confirm {
+		changes, err := planTransfer(remote, root, rsyncOpts)
+		if errors.Is(err, ErrRemoteNotFound) && len(opts.Paths) > 0 {
+			return fmt.Errorf("some of the paths don't exist on remote: %w", err)
+		}
+		if err != nil {
+			return err
+		}
+
+		if local.Git {
+			warnUncommitted(local, changes)
+		}
+		if !opts.Force {
+			logProgress("checking for local changes...")
+			conflicts, err := findPullConflicts(cfg, local, rsyncOpts, changes)
+			if err != nil {
+				return fmt.Errorf("failed to check local changes: %w", err)
+			}
+			if len(conflicts) > 0 {
+				logWarn("local has changes that would be overwritten:")
+				for _, c := range conflicts {
+					fmt.Printf("  %s\n", describeChange(c))
+				}
+				switch {
+				case opts.DryRun:
+				case !local.pushes():
+					logWarn("'%s' has mode '%s', proceeding anyway...", local.Name, local.mode())
+				default:
+					logSuccess("run 'gs push' first, or use 'gs pull --force' to overwrite")
+					return fmt.Errorf("pull aborted: %w", ErrLocalChanged)
+				}
+			}
+		}
+
+		report.Changes = describeChanges(changes)
+		if opts.DryRun || opts.Confirm {
+			proceed, err := confirmPlan(changes, "pull", local, opts)
+			if err != nil || !proceed {
+				return err
+			}
+		} else if !opts.Force {
+			if err := checkDeletions(cfg, changes, "pull"); err != nil {
+				return err
+			}
+		}
+	}
+
+	logProgress("pulling '%s'%s from server...", local.Name, describePaths(opts.Paths))
+	rsyncOpts.Live = true
+	rsyncOpts.Stats = true
+	result, err := runRsync(remote, root, rsyncOpts)
+	if errors.Is(err, ErrRemoteNotFound) && len(opts.Paths) > 0 {
+		return fmt.Errorf("some of the paths don't exist on remote: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	report.Changes = describeChanges(result.Changes)
+	report.Stats = statsOf(result)
+	local.git = nil // the pull may have changed the repository
+	if local.Encrypt {
+		if err := unstageLocal(cfg, local); err != nil {
+			return fmt.Errorf("failed to decrypt pulled files: %w", err)
+		}
+	}
+
+	logSuccess("pull complete for '%s'", local.Name)
+	if err := updateBaseline(cfg, local, opts.Paths); err != nil {
+		logWarn("failed to update baseline: %s", err)
+	}
+
+	if err := checkTransfer(cfg, local, opts, report); err != nil {
+		return err
+	}
+
+	return runHooks(cfg, local, "post_pull", report)
+}
+
+func cmdAuto(interval, timeout time.Duration, opts syncOptions) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Locals) == 0 {
+		return fmt.Errorf("no locals configured")
+	}
+
+	logProgress("waiting for server %s:%s...", cfg.Server, cfg.Port)
+	if err := waitForServer(cfg.Server, cfg.Port, interval, timeout); err != nil {
+		notifyFailure(cfg, "auto", "", err)
+		return err
+	}
+
+	var locals []*Local
+	for i := range cfg.Locals {
+		if local := &cfg.Locals[i]; local.pulls() {
+			locals = append(locals, local)
+		} else {
+			logDebug("skipping '%s' (mode '%s')", local.Name, local.mode())
+		}
+	}
+	logProgress("server is reachable, pulling %d local(s)...", len(locals))
+
+	failed := syncMetered(cfg, locals, "pull", interval, timeout, func(local *Local) error {
+		return pullLocal(cfg, local, opts)
+	})
+
+	if err := registerDevice(cfg, false); err != nil {
+		logWarn("%s", err)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to pull: %v", failed)
+	}
+
+	logSuccess("auto-pull complete for all locals")
+
+	return nil
+}
+
+func cmdRemoteLs() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	logProgress("listing %s:%s...", cfg.Server, cfg.RemotePath)
+	dirs, err := listRemoteDirs(cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(dirs) == 0 {
+		logSuccess("no directories on remote yet")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tSIZE\tFILES\tMODIFIED\tTRACKED")
+	for _, d := range dirs {
+		modified := "-"
+		if !d.Modified.IsZero() {
+			modified = d.Modified.Local().Format("2006-01-02 15:04")
+		}
+
+		// nested remote subdirs show up under their top-level directory
+		var tracked []string
+		for _, l := range cfg.Locals {
+			if l.RemoteDir() == d.Name || strings.HasPrefix(l.RemoteDir(), d.Name+"/") {
+				tracked = append(tracked, l.Name)
+			}
+		}
+		trackedStr := "-"
+		if len(tracked) > 0 {
+			trackedStr = strings.Join(tracked, ", ")
+		}
+
+		fmt.Fprintf(w, "  %s\t%s\t%d\t%s\t%s\n", d.Name, formatSize(d.Size), d.Files, modified, trackedStr)
+	}
+
+	return w.Flush()
+}
+
+func cmdClone(remoteDir, dest, name string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("no config found (run 'gs init' first)")
+	}
+
+	remoteDir = strings.Trim(remoteDir, "/")
+	if err := validRemoteSubdir(remoteDir); err != nil || remoteDir == "" {
+		return fmt.Errorf("invalid remote directory '%s'", remoteDir)
+	}
+	if existing := cfg.FindLocalByRemoteDir(remoteDir); existing != nil {
+		return fmt.Errorf("remote directory '%s' is already tracked by local '%s' (%s)", remoteDir, existing.Name, existing.Path)
+	}
+
+	if name == "" {
+		name = path.Base(remoteDir)
+	}
+	if dest == "" {
+		dest = name
+	}
+	dest, err = filepath.Abs(expandPath(dest))
+	if err != nil {
+		return fmt.Errorf("failed to resolve '%s': %w", dest, err)
+	}
+
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return fmt.Errorf("destination '%s' exists and is not empty", dest)
+	}
+
+	local := Local{Name: name, Path: dest}
+	if remoteDir != name {
+		local.RemoteSubdir = remoteDir
+	}
+	// only saved once the remote directory is known to exist
+	if err := cfg.addLocal(local); err != nil {
+		return err
+	}
+
+	logProgress("checking %s:%s...", cfg.Server, cfg.remoteDirPath(remoteDir))
+	exists, err := remoteDirExists(cfg, remoteDir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("remote directory '%s' does not exist (see 'gs remote ls')", remoteDir)
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create '%s': %w", dest, err)
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		return err
+	}
+	logSuccess("tracking '%s' (%s) -> %s", name, dest, cfg.RemoteForLocal(&local))
+	if err := registerDevice(cfg, false); err != nil {
+		logWarn("%s", err)
+	}
+
+	if err := pullLocal(cfg, cfg.FindLocalByName(name), syncOptions{}); err != nil {
+		logWarn("initial pull failed, retry with 'gs pull' in %s", dest)
+		return err
+	}
+
+	return nil
+}
+
+func cmdConfigList() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range cfg.ListKeys() {
+		fmt.Printf("%s = %s\n", k.Key, k.Value)
+	}
+
+	return nil
+}
+
+func cmdConfigGet(key string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	keys, err := cfg.GetKey(key)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 1 && keys[0].Key == key {
+		fmt.Println(keys[0].Value)
+		return nil
+	}
+	for _, k := range keys {
+		fmt.Printf("%s = %s\n", k.Key, k.Value)
+	}
+
+	return nil
+}
+
+func cmdConfigSet(key, value string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.SetKey(key, value); err != nil {
+		return err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("refusing to save invalid config: %w", err)
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		return err
+	}
+
+	logSuccess("set %s", key)
+
+	return nil
+}
+
+func cmdConfigUnset(key string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.UnsetKey(key); err != nil {
+		return err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("refusing to save invalid config: %w", err)
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		return err
+	}
+
+	logSuccess("unset %s", key)
+
+	return nil
+}
+
+func cmdConfigEdit() error {
+	original, err := os.ReadFile(configPath())
+	if err != nil {
+		return fmt.Errorf("no config found (run 'gs init' first)")
+	}
+	// a config that's already broken can be fixed by hand
+	before, _ := parseConfig(original)
+
+	// edit a copy so a broken config never replaces the working one
+	tmp, err := os.CreateTemp("", "gs-*.toml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(original); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	for {
+		cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", tmp.Name())
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("editor failed: %w", err)
+		}
+
+		edited, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(edited, original) {
+			logSuccess("no changes")
+			return nil
+		}
+
+		cfg, err := parseConfig(edited)
+		if err == nil {
+			err = validateConfig(cfg)
+		}
+		if err == nil && before != nil {
+			err = checkCommandKeys(before, cfg)
+		}
+		if err == nil {
+			if err := writeConfigFile(edited); err != nil {
+				return err
+			}
+			logSuccess("config saved to %s", configPath())
+			return nil
+		}
+
+		logWarn("invalid config: %s", err)
+		if !confirm("re-open editor?", true) {
+			return fmt.Errorf("edit aborted, config left unchanged")
+		}
+	}
+}
+
+func cmdExclude(add bool, patterns []string, localName string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	excludes := &cfg.Excludes
+	scope := "global"
+	if localName != "" {
+		local := cfg.FindLocalByName(localName)
+		if local == nil {
+			return fmt.Errorf("no local named '%s'", localName)
+		}
+		excludes = &local.Excludes
+		scope = fmt.Sprintf("'%s'", local.Name)
+	}
+
+	for _, p := range patterns {
+		idx := slices.Index(*excludes, p)
+		switch {
+		case add && idx == -1:
+			*excludes = append(*excludes, p)
+			logSuccess("excluding '%s' (%s)", p, scope)
+		case add:
+			logWarn("'%s' is already excluded (%s)", p, scope)
+		case idx != -1:
+			*excludes = slices.Delete(*excludes, idx, idx+1)
+			logSuccess("no longer excluding '%s' (%s)", p, scope)
+		default:
+			logWarn("'%s' is not excluded (%s)", p, scope)
+		}
+	}
+
+	return saveConfig(cfg)
+}
+
+// shared so buffered input isn't lost between prompts
+var stdin = bufio.NewReader(os.Stdin)
+
+func confirm(question string, def bool) bool {
+	hint := "[y/N]"
+	if def {
+		hint = "[Y/n]"
+	}
+	fmt.Printf("[?] %s %s ", question, hint)
+
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "":
+		return def
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -3,15 +3,39 @@ package main
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Local struct {
-	Name string `toml:"name"`
-	Path string `toml:"path"`
+	Name         string   `toml:"name"`
+	Path         string   `toml:"path"`
+	RemoteSubdir string   `toml:"remote_subdir,omitempty"`
+	Mode         string   `toml:"mode,omitempty"` // which way the local is synced, see mode.go
+	Excludes     []string `toml:"excludes,omitempty"`
+	Encrypt      bool     `toml:"encrypt,omitempty"`       // encrypt remote data client-side
+	EncryptNames bool     `toml:"encrypt_names,omitempty"` // also encrypt file and directory names
+	KeyFile      string   `toml:"key_file,omitempty"`      // use a key file instead of a passphrase
+	Checksum     bool     `toml:"checksum,omitempty"`      // compare contents instead of size and mtime
+	Verify       bool     `toml:"verify,omitempty"`        // compare hashes of both sides after transfers
+	BwLimit      string   `toml:"bwlimit,omitempty"`       // overrides the global bandwidth limit
+	Symlinks     string   `toml:"symlinks,omitempty"`      // "preserve", "follow" or "skip", see metadata.go
+	Perms        string   `toml:"perms,omitempty"`         // "preserve" or "normalize"
+	Chmod        string   `toml:"chmod,omitempty"`         // permissions with perms = "normalize"
+	Owner        bool     `toml:"owner,omitempty"`         // preserve owner and group
+	MaxFileSize  string   `toml:"max_file_size,omitempty"` // skip larger files, e.g. '500M'
+	Hooks        Hooks    `toml:"hooks,omitempty"`         // run after the global hooks
+	Git          bool     `toml:"git,omitempty"`           // the local is a git repository
+	SyncGitDir   bool     `toml:"sync_git_dir,omitempty"`  // also sync .git while the repository is clean
+
+	extra  map[string]any // keys unknown to this version, kept when saving
+	cipher *localCipher   // set once an encrypted local is unlocked
+	git    *gitState      // set once a git local is inspected
 }
 
 type Config struct {
@@ -19,14 +43,72 @@ type Config struct {
 	Port       string   `toml:"port"`
 	RemotePath string   `toml:"remote_path"`
 	Excludes   []string `toml:"excludes"`
-	Locals     []Local  `toml:"locals"`
+	Device     string   `toml:"device,omitempty"`
+	BwLimit    string   `toml:"bwlimit,omitempty"`
+	Metered    Metered  `toml:"metered,omitempty"`
+	LogFile    string   `toml:"log_file,omitempty"`     // also log to this file
+	LogMaxSize string   `toml:"log_max_size,omitempty"` // rotate the log file at this size, e.g. '10M'
+
+	MaxDeletions int        `toml:"max_deletions,omitzero"` // block transfers deleting more files, 0 for no limit
+	Notifiers    []Notifier `toml:"notifiers,omitempty"`
+	Hooks        Hooks      `toml:"hooks,omitempty"`
+	MetricsFile  string     `toml:"metrics_file,omitempty"`   // prometheus textfile, e.g. for node_exporter
+	WarnFileSize string     `toml:"warn_file_size,omitempty"` // status warns about pending changes of larger files
+
+	Locals []Local `toml:"locals"`
+
+	extra map[string]any
+}
+
+// RemoteDir returns the directory of the local relative to the remote path,
+// which defaults to the local's name
+func (l *Local) RemoteDir() string {
+	if l.RemoteSubdir != "" {
+		return l.RemoteSubdir
+	}
+
+	return l.Name
 }
 
 func (c *Config) RemoteForLocal(l *Local) string {
-	return fmt.Sprintf("%s:%s/%s", c.Server, c.RemotePath, l.Name)
+	return fmt.Sprintf("%s:%s/%s", c.Server, c.RemotePath, l.RemoteDir())
+}
+
+func (c *Config) FindLocalByRemoteDir(dir string) *Local {
+	for i := range c.Locals {
+		if pathsOverlap(c.Locals[i].RemoteDir(), dir) {
+			return &c.Locals[i]
+		}
+	}
+
+	return nil
 }
 
+// ExcludesForLocal returns the global excludes followed by the local's own,
+// and the directory of interrupted transfers
+func (c *Config) ExcludesForLocal(l *Local) []string {
+	excludes := make([]string, 0, len(c.Excludes)+len(l.Excludes)+1)
+	excludes = append(excludes, c.Excludes...)
+	excludes = append(excludes, l.Excludes...)
+	excludes = append(excludes, partialDir+"/")
+	if l.Git {
+		return gitExcludes(l, excludes)
+	}
+
+	return excludes
+}
+
+// set from the global '--config' and '--profile' flags
+var (
+	configOverride string
+	configProfile  string
+)
+
 func configDir() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "gs")
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return ""
@@ -35,10 +117,53 @@ func configDir() string {
 	return filepath.Join(home, ".config", "gs")
 }
 
+// stateDir holds data gs keeps between runs that isn't configuration
+func stateDir() string {
+	if xdg := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "gs")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".local", "state", "gs")
+}
+
+// configPath resolves the config file; flags take precedence over the
+// environment, and an explicit file over a profile
 func configPath() string {
+	if configOverride != "" {
+		return expandPath(configOverride)
+	}
+	if profile := activeProfile(); profile != "" {
+		return filepath.Join(configDir(), "profiles", profile+".toml")
+	}
+	if env := os.Getenv("GS_CONFIG"); env != "" {
+		return expandPath(env)
+	}
+
 	return filepath.Join(configDir(), "gs.toml")
 }
 
+func activeProfile() string {
+	switch {
+	case configOverride != "":
+		return ""
+	case configProfile != "":
+		return configProfile
+	case os.Getenv("GS_CONFIG") != "":
+		return ""
+	}
+
+	return os.Getenv("GS_PROFILE")
+}
+
+func validProfileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
 func loadConfig() (*Config, error) {
 	path := configPath()
 	data, err := os.ReadFile(path)
@@ -46,13 +171,27 @@ func loadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
 	var cfg Config
 	if err := toml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
+	var raw map[string]any
+	if err := toml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	cfg.extra = unknownKeys(raw, reflect.TypeOf(cfg))
+
+	rawLocals, _ := raw["locals"].([]map[string]any)
 	for i := range cfg.Locals {
 		cfg.Locals[i].Path = expandPath(cfg.Locals[i].Path)
+		if i < len(rawLocals) {
+			cfg.Locals[i].extra = unknownKeys(rawLocals[i], reflect.TypeOf(cfg.Locals[i]))
+		}
 	}
 
 	return &cfg, nil
@@ -80,15 +219,50 @@ func (c *Config) FindLocalByName(name string) *Local {
 }
 
 func (c *Config) AddLocal(name, path string) error {
-    // we shouldn't allow locals with same name due to potential conflicts at remote
-    // e.g. '~/documents/pdfs' and '~/notes/pdfs' would both be stored as '<remote>/pdfs'
-	if existing := c.FindLocalByName(name); existing != nil {
-		return fmt.Errorf("local '%s' already exists (names must be unique across all tracked directories)", name)
+	return c.addLocal(Local{Name: name, Path: path})
+}
+
+func (c *Config) addLocal(l Local) error {
+	if err := validLocalName(l.Name); err != nil {
+		return err
+	}
+	if existing := c.FindLocalByName(l.Name); existing != nil {
+		return fmt.Errorf("local '%s' already exists (use --name to pick another)", l.Name)
+	}
+	for i := range c.Locals {
+		if pathsOverlap(c.Locals[i].Path, l.Path) {
+			return fmt.Errorf("path '%s' overlaps with local '%s' (%s)", l.Path, c.Locals[i].Name, c.Locals[i].Path)
+		}
+	}
+	if err := validRemoteSubdir(l.RemoteSubdir); err != nil {
+		return err
+	}
+	// two locals sharing a remote directory would overwrite each other
+	if existing := c.FindLocalByRemoteDir(l.RemoteDir()); existing != nil {
+		return fmt.Errorf("remote directory '%s' overlaps with local '%s' (use --remote-subdir to pick another)", l.RemoteDir(), existing.Name)
+	}
+	c.Locals = append(c.Locals, l)
+
+	return nil
+}
+
+func validRemoteSubdir(dir string) error {
+	if dir == "" {
+		return nil
 	}
-	if existing := c.FindLocalForPath(path); existing != nil {
-		return fmt.Errorf("path '%s' already configured as local '%s'", path, existing.Name)
+	if path.IsAbs(dir) || path.Clean(dir) != dir || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return fmt.Errorf("invalid remote subdir '%s' (must be a clean path relative to remote_path)", dir)
+	}
+
+	return nil
+}
+
+// validLocalName rejects names that aren't a single path element, as the
+// name is the default remote directory under remote_path
+func validLocalName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid local name '%s'", name)
 	}
-	c.Locals = append(c.Locals, Local{Name: name, Path: path})
 
 	return nil
 }
@@ -102,23 +276,168 @@ func (c *Config) RemoveLocal(name string) {
 	}
 }
 
+func validateConfig(cfg *Config) error {
+	if cfg.Server == "" {
+		return fmt.Errorf("'server' must be set")
+	}
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port '%s'", cfg.Port)
+	}
+	if !strings.HasPrefix(cfg.RemotePath, "/") {
+		return fmt.Errorf("'remote_path' must be an absolute path")
+	}
+	if err := validBwLimit(cfg.BwLimit); err != nil {
+		return err
+	}
+	if err := cfg.Metered.validate(); err != nil {
+		return err
+	}
+	if cfg.LogMaxSize != "" {
+		if _, err := parseSize(cfg.LogMaxSize); err != nil {
+			return fmt.Errorf("invalid log_max_size: %w", err)
+		}
+	}
+	if cfg.WarnFileSize != "" {
+		if _, err := parseSize(cfg.WarnFileSize); err != nil {
+			return fmt.Errorf("invalid warn_file_size: %w", err)
+		}
+	}
+	if cfg.MaxDeletions < 0 {
+		return fmt.Errorf("'max_deletions' can't be negative")
+	}
+	for i := range cfg.Notifiers {
+		n := &cfg.Notifiers[i]
+		if err := n.validate(); err != nil {
+			return err
+		}
+		for j := range cfg.Notifiers[:i] {
+			if cfg.Notifiers[j].Name == n.Name {
+				return fmt.Errorf("duplicate notifier name '%s'", n.Name)
+			}
+		}
+	}
+
+	for i := range cfg.Locals {
+		l := &cfg.Locals[i]
+		if err := validLocalName(l.Name); err != nil {
+			return err
+		}
+		if !filepath.IsAbs(expandPath(l.Path)) {
+			return fmt.Errorf("path of local '%s' must be absolute", l.Name)
+		}
+		if err := validRemoteSubdir(l.RemoteSubdir); err != nil {
+			return fmt.Errorf("local '%s': %w", l.Name, err)
+		}
+		if !l.Encrypt && (l.EncryptNames || l.KeyFile != "") {
+			return fmt.Errorf("local '%s': 'encrypt_names' and 'key_file' require 'encrypt'", l.Name)
+		}
+		// every encryption uses a fresh salt, so contents never compare equal
+		if l.Encrypt && l.Checksum {
+			return fmt.Errorf("local '%s': 'checksum' can't be used with 'encrypt'", l.Name)
+		}
+		if err := validBwLimit(l.BwLimit); err != nil {
+			return fmt.Errorf("local '%s': %w", l.Name, err)
+		}
+		if err := validMode(l.Mode); err != nil {
+			return fmt.Errorf("local '%s': %w", l.Name, err)
+		}
+		if err := validMetadataPolicy(l); err != nil {
+			return fmt.Errorf("local '%s': %w", l.Name, err)
+		}
+		if l.MaxFileSize != "" {
+			if _, err := parseSize(l.MaxFileSize); err != nil {
+				return fmt.Errorf("local '%s': invalid max_file_size: %w", l.Name, err)
+			}
+		}
+		if l.SyncGitDir && !l.Git {
+			return fmt.Errorf("local '%s': 'sync_git_dir' requires 'git'", l.Name)
+		}
+		for j := range cfg.Locals[:i] {
+			other := &cfg.Locals[j]
+			if other.Name == l.Name {
+				return fmt.Errorf("duplicate local name '%s'", l.Name)
+			}
+			if pathsOverlap(expandPath(other.Path), expandPath(l.Path)) {
+				return fmt.Errorf("paths of locals '%s' and '%s' overlap", other.Name, l.Name)
+			}
+			if pathsOverlap(other.RemoteDir(), l.RemoteDir()) {
+				return fmt.Errorf("remote directories of locals '%s' and '%s' overlap", other.Name, l.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func pathsOverlap(a, b string) bool {
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
 func saveConfig(cfg *Config) error {
-	dir := configDir()
+	data, err := encodeConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	if old, err := os.ReadFile(configPath()); err == nil {
+		data = preserveLayout(old, data)
+	}
+
+	return writeConfigFile(data)
+}
+
+// writeConfigFile replaces the config atomically, keeping the previous version
+// next to it as '<config>.bak'
+func writeConfigFile(data []byte) error {
+	path := configPath()
+	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 
-	f, err := os.Create(configPath())
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+		old, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to back up config: %w", err)
+		}
+		if err := os.WriteFile(path+".bak", old, mode); err != nil {
+			return fmt.Errorf("failed to back up config: %w", err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
 		return fmt.Errorf("failed to create config file: %w", err)
 	}
-	defer f.Close()
+	defer os.Remove(tmp.Name())
 
-	encoder := toml.NewEncoder(f)
-	if err := encoder.Encode(cfg); err != nil {
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
 		return fmt.Errorf("failed to write config: %w", err)
 	}
 
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace config: %w", err)
+	}
+
+	// persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
 	return nil
 }
 
@@ -143,4 +462,3 @@ func parseRemote(remote string) (host, port, path string, err error) {
 
 	return parts[0], parts[1], strings.TrimSuffix(parts[2], "/"), nil
 }
-
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// saving the config re-encodes it from the structs, so anything the structs
+// don't know about would be lost on every write; to avoid that keys unknown to
+// this version are carried over verbatim, and comments and key ordering of the
+// file on disk are re-applied to the freshly encoded output
+
+func encodeTOML(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// unknownKeys returns the entries of raw that don't map to a field of t
+func unknownKeys(raw map[string]any, t reflect.Type) map[string]any {
+	known := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			known[tomlName(t.Field(i))] = true
+		}
+	}
+
+	var extra map[string]any
+	for k, v := range raw {
+		if !known[k] {
+			if extra == nil {
+				extra = make(map[string]any)
+			}
+			extra[k] = v
+		}
+	}
+
+	return extra
+}
+
+// splitTables splits encoded toml into its leading key/value lines and the
+// tables following them, treating the first skip lines as part of the keys
+func splitTables(data []byte, skip int) (keys, tables []byte) {
+	lines := strings.SplitAfter(string(data), "\n")
+	for i := skip; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "[") {
+			return []byte(strings.Join(lines[:i], "")), []byte(strings.Join(lines[i:], ""))
+		}
+	}
+
+	return data, nil
+}
+
+func appendTables(buf *bytes.Buffer, tables []byte) {
+	tables = bytes.TrimLeft(tables, "\n")
+	if len(tables) == 0 {
+		return
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+		buf.WriteString("\n")
+	}
+	buf.Write(tables)
+}
+
+func encodeConfig(cfg *Config) ([]byte, error) {
+	var buf bytes.Buffer
+
+	top := *cfg
+	top.Locals = nil
+	known, err := encodeTOML(top)
+	if err != nil {
+		return nil, err
+	}
+	keys, tables := splitTables(known, 0)
+	buf.Write(bytes.TrimRight(keys, "\n"))
+	buf.WriteString("\n")
+
+	var extraTables []byte
+	if len(cfg.extra) > 0 {
+		extra, err := encodeTOML(cfg.extra)
+		if err != nil {
+			return nil, err
+		}
+		var extraKeys []byte
+		extraKeys, extraTables = splitTables(extra, 0)
+		buf.Write(bytes.TrimLeft(extraKeys, "\n"))
+	}
+	appendTables(&buf, tables)
+	appendTables(&buf, extraTables)
+
+	for _, l := range cfg.Locals {
+		known, err := encodeTOML(struct {
+			Locals []Local `toml:"locals"`
+		}{[]Local{l}})
+		if err != nil {
+			return nil, err
+		}
+		keys, tables := splitTables(known, 1)
+		appendTables(&buf, keys)
+
+		var extraTables []byte
+		if len(l.extra) > 0 {
+			extra, err := encodeTOML(map[string]any{"locals": []map[string]any{l.extra}})
+			if err != nil {
+				return nil, err
+			}
+			var extraKeys []byte
+			extraKeys, extraTables = splitTables(extra, 1)
+			// drop the '[[locals]]' header, the keys belong to the one above
+			_, extraKeys, _ = bytes.Cut(extraKeys, []byte("\n"))
+			buf.Write(extraKeys)
+		}
+		appendTables(&buf, tables)
+		appendTables(&buf, extraTables)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// lineIDs identifies every key and table header line of a toml document by
+// its full path, with elements of table arrays identified by their 'name' key
+// (e.g. 'locals[notes].path') so they can be matched across documents even
+// when entries are added or removed; other lines get an empty id
+func lineIDs(lines []string) []string {
+	ids := make([]string, len(lines))
+	table, arrayBase, arrayElem := "", "", ""
+	depth := 0
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if depth > 0 {
+			depth += bracketDelta(trimmed)
+			continue
+		}
+
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "[["):
+			arrayBase = tableName(trimmed)
+			arrayElem = fmt.Sprintf("%s[%s]", arrayBase, arrayElemName(lines[i+1:], i))
+			table = arrayElem
+			ids[i] = "[[" + table + "]]"
+		case strings.HasPrefix(trimmed, "["):
+			table = tableName(trimmed)
+			if arrayBase != "" && strings.HasPrefix(table, arrayBase+".") {
+				table = arrayElem + strings.TrimPrefix(table, arrayBase)
+			}
+			ids[i] = "[" + table + "]"
+		default:
+			key, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				continue
+			}
+			key = strings.Trim(strings.TrimSpace(key), `"'`)
+			if table != "" {
+				key = table + "." + key
+			}
+			ids[i] = key
+			depth = bracketDelta(value)
+		}
+	}
+
+	return ids
+}
+
+func tableName(header string) string {
+	header = stripComment(header)
+	return strings.TrimSpace(strings.Trim(header, "[] \t"))
+}
+
+// arrayElemName finds the 'name' key of a table array element, falling back
+// to its position in the document
+func arrayElemName(rest []string, pos int) string {
+	for _, line := range rest {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			break
+		}
+		key, value, ok := strings.Cut(trimmed, "=")
+		if ok && strings.TrimSpace(key) == "name" {
+			return strings.Trim(strings.TrimSpace(stripComment(value)), `"'`)
+		}
+	}
+
+	return fmt.Sprintf("#%d", pos)
+}
+
+func stripComment(s string) string {
+	inQuote := rune(0)
+	for i, r := range s {
+		switch {
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote == 0 && (r == '"' || r == '\''):
+			inQuote = r
+		case inQuote == 0 && r == '#':
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+// bracketDelta counts unclosed array brackets, used to skip the continuation
+// lines of multi-line arrays
+func bracketDelta(s string) int {
+	depth := 0
+	inQuote := rune(0)
+	for _, r := range stripComment(s) {
+		switch {
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote == 0 && (r == '"' || r == '\''):
+			inQuote = r
+		case inQuote == 0 && r == '[':
+			depth++
+		case inQuote == 0 && r == ']':
+			depth--
+		}
+	}
+
+	return depth
+}
+
+// preserveLayout re-applies the comments and key ordering of old onto the
+// freshly encoded updated document; comments are attached to the key or table
+// below them and disappear with it, trailing comments on value lines are lost
+func preserveLayout(old, updated []byte) []byte {
+	oldLines := strings.Split(strings.TrimRight(string(old), "\n"), "\n")
+	oldIDs := lineIDs(oldLines)
+
+	position := make(map[string]int)
+	comments := make(map[string][]string)
+	var pending []string
+	for i, line := range oldLines {
+		if oldIDs[i] == "" {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "#") || (trimmed == "" && len(pending) > 0) {
+				pending = append(pending, line)
+			}
+			continue
+		}
+
+		position[oldIDs[i]] = i
+		if strings.HasPrefix(oldIDs[i], "[") {
+			// table headers already get a blank line before them
+			for len(pending) > 0 && strings.TrimSpace(pending[len(pending)-1]) == "" {
+				pending = pending[:len(pending)-1]
+			}
+		}
+		if len(pending) > 0 {
+			comments[oldIDs[i]] = pending
+			pending = nil
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(string(updated), "\n"), "\n")
+	ids := lineIDs(lines)
+
+	// reorder keys within each table to match the old document, new keys last
+	for start := 0; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && !strings.HasPrefix(ids[end], "[") {
+			end++
+		}
+
+		var keys []int
+		for i := start; i < end; i++ {
+			if ids[i] != "" && !strings.HasPrefix(ids[i], "[") {
+				keys = append(keys, i)
+			}
+		}
+		sorted := slices.Clone(keys)
+		sort.SliceStable(sorted, func(a, b int) bool {
+			pa, okA := position[ids[sorted[a]]]
+			pb, okB := position[ids[sorted[b]]]
+			if okA != okB {
+				return okA
+			}
+			return okA && pa < pb
+		})
+
+		origLines, origIDs := slices.Clone(lines), slices.Clone(ids)
+		for n, i := range keys {
+			lines[i], ids[i] = origLines[sorted[n]], origIDs[sorted[n]]
+		}
+
+		start = end
+	}
+
+	var out strings.Builder
+	for i, line := range lines {
+		for _, c := range comments[ids[i]] {
+			out.WriteString(c + "\n")
+		}
+		out.WriteString(line + "\n")
+	}
+	for _, c := range pending {
+		if strings.TrimSpace(c) != "" {
+			out.WriteString(c + "\n")
+		}
+	}
+
+	return []byte(out.String())
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config keys are dotted toml paths, e.g. 'remote_path' or 'locals.notes.excludes',
+// where the segment after 'locals' selects the local by name instead of index
+
+type configKey struct {
+	Key   string
+	Value string
+}
+
+func tomlName(f reflect.StructField) string {
+	tag := f.Tag.Get("toml")
+	if tag == "-" {
+		return ""
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+
+	return name
+}
+
+func fieldByTomlName(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() && tomlName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+func lookupKey(cfg *Config, key string) (reflect.Value, error) {
+	if key == "" {
+		return reflect.Value{}, fmt.Errorf("empty config key")
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	segments := strings.Split(key, ".")
+	for i := 0; i < len(segments); i++ {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("unknown config key '%s'", key)
+		}
+
+		field, ok := fieldByTomlName(v, segments[i])
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("unknown config key '%s'", key)
+		}
+		v = field
+
+		// tables in arrays (locals) are addressed by their name
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct {
+			if i+1 >= len(segments) {
+				return reflect.Value{}, fmt.Errorf("key '%s' is a list of tables, use '%s.<name>.<key>'", key, key)
+			}
+			i++
+			elem, ok := sliceElemByName(v, segments[i])
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("no entry '%s' in '%s'", segments[i], strings.Join(segments[:i], "."))
+			}
+			v = elem
+		}
+	}
+
+	return v, nil
+}
+
+func sliceElemByName(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.Len(); i++ {
+		if field, ok := fieldByTomlName(v.Index(i), "name"); ok && field.String() == name {
+			return v.Index(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// formatValue renders a value the way it'd be written in the toml file
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice && v.Len() == 0 {
+		return "[]"
+	}
+
+	data, err := toml.Marshal(map[string]any{"v": v.Interface()})
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(string(data), "v = "))
+}
+
+// parseValue decodes a toml value into the type of the target field, falling
+// back to the raw input for plain strings so quoting isn't required
+func parseValue(t reflect.Type, raw string) (reflect.Value, error) {
+	holder := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "V", Type: t, Tag: `toml:"v"`},
+	}))
+
+	if _, err := toml.Decode("v = "+raw, holder.Interface()); err != nil {
+		if t.Kind() == reflect.String {
+			return reflect.ValueOf(raw).Convert(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("invalid value %q for %s: %w", raw, t, err)
+	}
+
+	return holder.Elem().Field(0), nil
+}
+
+func (c *Config) GetKey(key string) ([]configKey, error) {
+	v, err := lookupKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if indirect(v).Kind() == reflect.Struct {
+		return flattenKeys(key, indirect(v), true), nil
+	}
+
+	return []configKey{{Key: key, Value: formatValue(v)}}, nil
+}
+
+// keys of a local that the remote directory and local state depend on, they
+// can only be changed by the commands moving those along
+var commandKeys = map[string]string{
+	"name":          "use 'gs rename' to rename the local and move its remote directory",
+	"path":          "use 'gs relocate' to point the local at a new path",
+	"remote_subdir": "use 'gs rename <name> <name> --remote-subdir <dir>' to move the remote directory",
+}
+
+func checkCommandKey(key string) error {
+	segments := strings.Split(key, ".")
+	if len(segments) != 3 || segments[0] != "locals" {
+		return nil
+	}
+	if _, ok := commandKeys[segments[2]]; ok {
+		return commandKeyError(key, segments[2])
+	}
+
+	return nil
+}
+
+func commandKeyError(key, field string) error {
+	return fmt.Errorf("'%s' can't be changed with 'gs config', %s", key, commandKeys[field])
+}
+
+// checkCommandKeys returns an error if after changes a key of a local that
+// only commands may change, e.g. in 'gs config edit'. locals are matched by
+// name, and a new name on the path of a local that's gone is a rename
+func checkCommandKeys(before, after *Config) error {
+	for i := range after.Locals {
+		l := &after.Locals[i]
+		old := before.FindLocalByName(l.Name)
+		if old == nil {
+			for j := range before.Locals {
+				prev := &before.Locals[j]
+				if expandPath(prev.Path) == expandPath(l.Path) && after.FindLocalByName(prev.Name) == nil {
+					return commandKeyError("locals."+prev.Name+".name", "name")
+				}
+			}
+			continue
+		}
+		if expandPath(l.Path) != expandPath(old.Path) {
+			return commandKeyError("locals."+l.Name+".path", "path")
+		}
+		if l.RemoteSubdir != old.RemoteSubdir {
+			return commandKeyError("locals."+l.Name+".remote_subdir", "remote_subdir")
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) SetKey(key, raw string) error {
+	if err := checkCommandKey(key); err != nil {
+		return err
+	}
+	v, err := lookupKey(c, key)
+	if err != nil {
+		return err
+	}
+	if indirect(v).Kind() == reflect.Struct {
+		return fmt.Errorf("key '%s' is a table, set its fields individually", key)
+	}
+
+	parsed, err := parseValue(v.Type(), raw)
+	if err != nil {
+		return err
+	}
+	v.Set(parsed)
+
+	return nil
+}
+
+func (c *Config) UnsetKey(key string) error {
+	if err := checkCommandKey(key); err != nil {
+		return err
+	}
+	v, err := lookupKey(c, key)
+	if err != nil {
+		return err
+	}
+	if indirect(v).Kind() == reflect.Struct {
+		return fmt.Errorf("key '%s' is a table, unset its fields individually", key)
+	}
+	v.Set(reflect.Zero(v.Type()))
+
+	return nil
+}
+
+// ListKeys returns every non-empty key in the config, top-level keys first
+func (c *Config) ListKeys() []configKey {
+	return flattenKeys("", reflect.ValueOf(c).Elem(), false)
+}
+
+func flattenKeys(prefix string, v reflect.Value, all bool) []configKey {
+	var keys, tables []configKey
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := tomlName(t.Field(i))
+		if name == "" || !t.Field(i).IsExported() {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		field := indirect(v.Field(i))
+		switch {
+		case !field.IsValid():
+			continue
+		case field.Kind() == reflect.Struct:
+			tables = append(tables, flattenKeys(name, field, all)...)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < field.Len(); j++ {
+				elem := field.Index(j)
+				elemName, _ := fieldByTomlName(elem, "name")
+				tables = append(tables, flattenKeys(name+"."+elemName.String(), elem, all)...)
+			}
+		case all || !field.IsZero():
+			keys = append(keys, configKey{Key: name, Value: formatValue(field)})
+		}
+	}
+
+	return append(keys, tables...)
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+
+	return v
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// encrypted locals are encrypted client-side with XChaCha20-Poly1305: file contents
+// are split into chunks sealed with a per-file key (derived from a random salt
+// stored in the file header), and names are optionally encrypted
+// deterministically so the same name always maps to the same ciphertext and
+// rsync can still compare both sides. the master key comes from a keyfile or
+// a passphrase, and its parameters are kept in '.gs-key' at the root of the
+// remote directory so every device derives the same key
+
+const (
+	keyParamsFile    = ".gs-key"
+	fileMagic        = "GSE2"
+	fileSaltLen      = 16
+	chunkSize        = 64 * 1024
+	pbkdf2Iters      = 600000
+	maxNameLen       = 255
+	passphraseEnvVar = "GS_PASSPHRASE"
+)
+
+type keyParams struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"` // "keyfile" or "pbkdf2-sha256"
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Check      []byte `json:"check"` // detects a wrong key or passphrase
+}
+
+type localCipher struct {
+	fileKey []byte
+	nameKey []byte
+	nameMAC []byte
+	names   bool // encrypt file and directory names
+}
+
+func deriveKey(secret, salt []byte, info string) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	return key, nil
+}
+
+func newLocalCipher(master []byte, names bool) (*localCipher, error) {
+	c := &localCipher{names: names}
+	for _, k := range []struct {
+		key  *[]byte
+		info string
+	}{
+		{&c.fileKey, "gs file encryption"},
+		{&c.nameKey, "gs name encryption"},
+		{&c.nameMAC, "gs name nonce"},
+	} {
+		var err error
+		if *k.key, err = deriveKey(master, nil, k.info); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func keyCheck(master []byte) ([]byte, error) {
+	check, err := deriveKey(master, nil, "gs key check")
+	if err != nil {
+		return nil, err
+	}
+
+	return check[:16], nil
+}
+
+// chunkNonce is the chunk counter with the last byte marking the final chunk,
+// so truncating or reordering chunks fails authentication
+func chunkNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	binary.BigEndian.PutUint64(nonce, i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+func (c *localCipher) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(c.fileKey, salt, "gs file")
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+func (c *localCipher) encrypt(w io.Writer, r io.Reader) error {
+	salt := make([]byte, fileSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := c.fileAEAD(salt)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(fileMagic), salt...)); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, chunkSize)
+	buf := make([]byte, chunkSize)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			_, err := br.Peek(1)
+			last = err == io.EOF
+		}
+
+		if _, err := w.Write(aead.Seal(nil, chunkNonce(i, last), buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (c *localCipher) decrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, len(fileMagic)+fileSaltLen)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(fileMagic)]) != fileMagic {
+		return fmt.Errorf("not an encrypted file")
+	}
+	aead, err := c.fileAEAD(header[len(fileMagic):])
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, chunkSize+aead.Overhead())
+	buf := make([]byte, chunkSize+aead.Overhead())
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err == io.EOF {
+			return fmt.Errorf("encrypted file is truncated")
+		}
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			_, err := br.Peek(1)
+			last = err == io.EOF
+		}
+
+		plain, err := aead.Open(nil, chunkNonce(i, last), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt (wrong key or corrupted file): %w", err)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// encryptName encrypts a single path element; the nonce is derived from the
+// name itself, making the encryption deterministic
+func (c *localCipher) encryptName(name string) (string, error) {
+	mac := hmac.New(sha256.New, c.nameMAC)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:chacha20poly1305.NonceSizeX]
+
+	aead, err := chacha20poly1305.NewX(c.nameKey)
+	if err != nil {
+		return "", err
+	}
+	encrypted := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(name), nil))
+	if len(encrypted) > maxNameLen {
+		return "", fmt.Errorf("name '%s' is too long to be encrypted", name)
+	}
+
+	return encrypted, nil
+}
+
+func (c *localCipher) decryptName(encrypted string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < chacha20poly1305.NonceSizeX {
+		return "", fmt.Errorf("'%s' is not an encrypted name", encrypted)
+	}
+
+	aead, err := chacha20poly1305.NewX(c.nameKey)
+	if err != nil {
+		return "", err
+	}
+	nonce, sealed := data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:]
+	name, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt name '%s': %w", encrypted, err)
+	}
+
+	return string(name), nil
+}
+
+// encryptPath encrypts every element of a slash separated relative path,
+// keeping a trailing slash; it's a no-op unless names are encrypted
+func (c *localCipher) encryptPath(rel string) (string, error) {
+	return c.mapPath(rel, c.encryptName)
+}
+
+func (c *localCipher) decryptPath(rel string) (string, error) {
+	return c.mapPath(rel, c.decryptName)
+}
+
+func (c *localCipher) mapPath(rel string, fn func(string) (string, error)) (string, error) {
+	if !c.names || rel == keyParamsFile {
+		return rel, nil
+	}
+
+	trimmed := strings.TrimSuffix(rel, "/")
+	elems := strings.Split(trimmed, "/")
+	for i, elem := range elems {
+		if elem == "." || elem == "" {
+			continue
+		}
+		mapped, err := fn(elem)
+		if err != nil {
+			return "", err
+		}
+		elems[i] = mapped
+	}
+
+	return strings.Join(elems, "/") + strings.TrimPrefix(rel, trimmed), nil
+}
+
+// decryptChanges rewrites the paths of itemized changes to their plain names
+func (c *localCipher) decryptChanges(changes []string) []string {
+	decrypted := make([]string, len(changes))
+	for i, change := range changes {
+		decrypted[i] = change
+		rel := changePath(change)
+		if plain, err := c.decryptPath(rel); err == nil {
+			decrypted[i] = change[:len(change)-len(rel)] + plain
+		}
+	}
+
+	return decrypted
+}
+
+// decryptOutput rewrites the lines of rsync's output that are encrypted paths
+func (c *localCipher) decryptOutput(output string) string {
+	if !c.names {
+		return output
+	}
+
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if plain, err := c.decryptPath(line); err == nil {
+			lines[i] = plain
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(expandPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("key file '%s' must contain at least 32 hex encoded bytes (see 'gs keygen')", path)
+	}
+
+	return key, nil
+}
+
+func readPassphrase(prompt string) (string, error) {
+	if p := os.Getenv(passphraseEnvVar); p != "" {
+		return p, nil
+	}
+
+	fmt.Printf("[?] %s: ", prompt)
+	if setEcho(false) == nil {
+		defer func() {
+			setEcho(true)
+			fmt.Println()
+		}()
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("empty passphrase")
+	}
+
+	return passphrase, nil
+}
+
+func setEcho(on bool) error {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+
+	return cmd.Run()
+}
+
+// masterKey derives the local's master key according to params, asking for
+// the passphrase twice if it's about to be used for the first time
+func masterKey(l *Local, params *keyParams) ([]byte, error) {
+	switch params.KDF {
+	case "keyfile":
+		if l.KeyFile == "" {
+			return nil, fmt.Errorf("remote data of '%s' is encrypted with a key file, set 'key_file'", l.Name)
+		}
+		return readKeyFile(l.KeyFile)
+	case "pbkdf2-sha256":
+		if l.KeyFile != "" {
+			return nil, fmt.Errorf("remote data of '%s' is encrypted with a passphrase, unset 'key_file'", l.Name)
+		}
+		passphrase, err := readPassphrase(fmt.Sprintf("passphrase for '%s'", l.Name))
+		if err != nil {
+			return nil, err
+		}
+		if params.Check == nil && os.Getenv(passphraseEnvVar) == "" {
+			again, err := readPassphrase("repeat passphrase")
+			if err != nil {
+				return nil, err
+			}
+			if again != passphrase {
+				return nil, fmt.Errorf("passphrases don't match")
+			}
+		}
+		return pbkdf2.Key(sha256.New, passphrase, params.Salt, params.Iterations, 32)
+	}
+
+	return nil, fmt.Errorf("unsupported key derivation '%s'", params.KDF)
+}
+
+func newKeyParams(l *Local) (*keyParams, error) {
+	if l.KeyFile != "" {
+		return &keyParams{Version: 1, KDF: "keyfile"}, nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &keyParams{Version: 1, KDF: "pbkdf2-sha256", Iterations: pbkdf2Iters, Salt: salt}, nil
+}
+
+func parseKeyParams(data []byte) (*keyParams, error) {
+	var params keyParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", keyParamsFile, err)
+	}
+	if params.Version != 1 {
+		return nil, fmt.Errorf("unsupported %s version %d", keyParamsFile, params.Version)
+	}
+
+	return &params, nil
+}
+
+// loadKeyParams reads the key parameters from the staging directory, falling
+// back to the remote (e.g. on a new device) and returns nil if neither has them
+func loadKeyParams(cfg *Config, l *Local) (*keyParams, error) {
+	data, err := os.ReadFile(filepath.Join(stagingDir(l), keyParamsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		script := fmt.Sprintf("cat %s 2>/dev/null || true", shellQuote(cfg.remoteDirPath(l.RemoteDir())+"/"+keyParamsFile))
+		var output string
+		output, err = runSSH(cfg, script)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch key parameters: %w", err)
+		}
+		if strings.TrimSpace(output) == "" {
+			return nil, nil
+		}
+		data = []byte(output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeyParams(data)
+}
+
+// unlockLocal loads the cipher of an encrypted local, prompting for the
+// passphrase if needed; it's a no-op for plain locals or if already unlocked
+func unlockLocal(cfg *Config, l *Local) error {
+	if !l.Encrypt || l.cipher != nil {
+		return nil
+	}
+
+	params, err := loadKeyParams(cfg, l)
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		if params, err = newKeyParams(l); err != nil {
+			return err
+		}
+	}
+
+	master, err := masterKey(l, params)
+	if err != nil {
+		return err
+	}
+	check, err := keyCheck(master)
+	if err != nil {
+		return err
+	}
+	if params.Check != nil && !hmac.Equal(params.Check, check) {
+		return fmt.Errorf("wrong key or passphrase for '%s'", l.Name)
+	}
+	params.Check = check
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagingDir(l), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir(l), keyParamsFile), data, 0644); err != nil {
+		return err
+	}
+
+	l.cipher, err = newLocalCipher(master, l.EncryptNames)
+
+	return err
+}
+
+func cmdKeygen(path string) error {
+	path = expandPath(path)
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	logSuccess("key written to %s", path)
+	logWarn("keep a copy somewhere safe, encrypted data can't be recovered without it")
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// every device records the remote directories it tracks in
+// '<remote_path>/.gs/devices/<device>', so a remote directory is only an
+// orphan once no device lists it anymore
+
+const registryDir = ".gs"
+
+var unsafeDeviceChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// deviceName identifies this machine (and profile) in the registry
+func (c *Config) deviceName() string {
+	name := c.Device
+	if name == "" {
+		name, _ = os.Hostname()
+		if profile := activeProfile(); profile != "" {
+			name += "-" + profile
+		}
+	}
+
+	name = strings.Trim(unsafeDeviceChars.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		return "unknown"
+	}
+
+	return name
+}
+
+func (c *Config) trackedRemoteDirs() []string {
+	dirs := make([]string, 0, len(c.Locals))
+	for i := range c.Locals {
+		dirs = append(dirs, c.Locals[i].RemoteDir())
+	}
+	slices.Sort(dirs)
+
+	return dirs
+}
+
+const registerDeviceScript = `dir=%s/devices; mkdir -p "$dir" && cat > "$dir/.%s.tmp" && mv "$dir/.%s.tmp" "$dir/%s"`
+
+// registerDevice uploads the remote directories tracked by this device,
+// skipping the upload if nothing changed since the last registration
+func registerDevice(cfg *Config, force bool) error {
+	device := cfg.deviceName()
+	manifest := []byte(strings.Join(cfg.trackedRemoteDirs(), "\n") + "\n")
+
+	cache := filepath.Join(stateDir(), "registered", fmt.Sprintf("%s-%x", device, hashString(cfg.Server+":"+cfg.RemotePath)))
+	if cached, err := os.ReadFile(cache); !force && err == nil && bytes.Equal(cached, manifest) {
+		return nil
+	}
+
+	script := fmt.Sprintf(registerDeviceScript, shellQuote(cfg.remoteDirPath(registryDir)), device, device, device)
+	if _, err := runSSHInput(cfg, script, bytes.NewReader(manifest)); err != nil {
+		return fmt.Errorf("failed to register device: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cache), 0755); err == nil {
+		os.WriteFile(cache, manifest, 0644)
+	}
+
+	return nil
+}
+
+// updateDeviceRegistration is the best-effort variant used after config
+// changes, which shouldn't fail just because the server is unreachable
+func updateDeviceRegistration(cfg *Config) {
+	if !isServerReachable(cfg.Server, cfg.Port, 3*time.Second) {
+		logWarn("server unreachable, device registration will be updated on the next sync")
+		return
+	}
+
+	if err := registerDevice(cfg, false); err != nil {
+		logWarn("%s", err)
+	}
+}
+
+const readDevicesScript = `cd %s/devices 2>/dev/null || exit 0
+for f in *; do
+	[ -f "$f" ] || continue
+	printf '== %%s\n' "$f"
+	cat "$f"
+done`
+
+// remoteDevices returns the remote directories tracked by each device
+func remoteDevices(cfg *Config) (map[string][]string, error) {
+	output, err := runSSH(cfg, fmt.Sprintf(readDevicesScript, shellQuote(cfg.remoteDirPath(registryDir))))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDevices(output), nil
+}
+
+func parseDevices(output string) map[string][]string {
+	devices := make(map[string][]string)
+	device := ""
+	for _, line := range strings.Split(output, "\n") {
+		if name, ok := strings.CutPrefix(line, "== "); ok {
+			device = name
+			devices[device] = nil
+			continue
+		}
+		if device != "" && strings.TrimSpace(line) != "" {
+			devices[device] = append(devices[device], strings.TrimSpace(line))
+		}
+	}
+
+	return devices
+}
+
+// devicesTracking returns the devices other than this one that track dir or
+// a directory nested in it (or containing it)
+func devicesTracking(cfg *Config, devices map[string][]string, dir string) []string {
+	var names []string
+	for device, dirs := range devices {
+		if device == cfg.deviceName() {
+			continue
+		}
+		for _, d := range dirs {
+			if pathsOverlap(d, dir) {
+				names = append(names, device)
+				break
+			}
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// findOrphans returns the remote directories no registered device tracks
+func findOrphans(dirs []RemoteDir, devices map[string][]string) []RemoteDir {
+	var orphans []RemoteDir
+	for _, d := range dirs {
+		tracked := false
+		for _, deviceDirs := range devices {
+			for _, td := range deviceDirs {
+				if pathsOverlap(td, d.Name) {
+					tracked = true
+				}
+			}
+		}
+		if !tracked {
+			orphans = append(orphans, d)
+		}
+	}
+
+	return orphans
+}
+
+func hashString(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:4]
+}
+
+func archiveName(dir string, now time.Time) string {
+	return fmt.Sprintf("%s/archive/%s-%s", registryDir, strings.ReplaceAll(dir, "/", "_"), now.Format("20060102-150405"))
+}
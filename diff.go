@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// diffs compare the local files against copies of their remote versions
+// fetched into a temporary directory, so nothing on either side is touched
+
+// binarySniffLen is how much of a file is checked for NUL bytes, the same
+// heuristic git and diff use to tell binary files apart
+const binarySniffLen = 8000
+
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLen {
+		data = data[:binarySniffLen]
+	}
+
+	return bytes.IndexByte(data, 0) != -1
+}
+
+func isBinaryFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	return isBinary(buf[:n]), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// fetchRemote copies the remote versions of paths into dir, keeping their
+// relative layout; paths missing on the remote are simply not created
+func fetchRemote(cfg *Config, local *Local, paths []string, dir string) error {
+	if err := unlockLocal(cfg, local); err != nil {
+		return err
+	}
+
+	dst := dir
+	if local.Encrypt {
+		// fetched into a subdirectory first, then decrypted into dir
+		dst = filepath.Join(dir, ".gs-encrypted")
+	}
+
+	opts := rsyncOptions{Port: cfg.Port, Paths: paths, Cipher: local.cipher}
+	_, err := runRsync(cfg.RemoteForLocal(local), dst, opts)
+	if err != nil && !errors.Is(err, ErrRemoteNotFound) {
+		return fmt.Errorf("failed to fetch remote version: %w", err)
+	}
+
+	if local.Encrypt {
+		defer os.RemoveAll(dst)
+		if err := decryptTree(local.cipher, dst, dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to decrypt remote version: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// unifiedDiff runs diff -u on two files, returning whether they differ
+func unifiedDiff(w io.Writer, a, b, labelA, labelB string) (bool, error) {
+	cmd := exec.Command("diff", "-u", "--label", labelA, "--label", labelB, a, b)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("diff failed: %w", err)
+	}
+
+	return false, nil
+}
+
+// diffStat counts the lines added and removed going from a to b
+func diffStat(a, b string) (added, removed int, err error) {
+	var out bytes.Buffer
+	if _, err := unifiedDiff(&out, a, b, "a", "b"); err != nil {
+		return 0, 0, err
+	}
+	added, removed = countDiffLines(out.String())
+
+	return added, removed, nil
+}
+
+func countDiffLines(diff string) (added, removed int) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+
+	return added, removed
+}
+
+func runDiffTool(tool, a, b string) error {
+	cmd := exec.Command("sh", "-c", tool+` "$1" "$2"`, "sh", a, b)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		// most diff tools exit non-zero when the files differ
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil
+		}
+		return fmt.Errorf("diff tool failed: %w", err)
+	}
+
+	return nil
+}
+
+func cmdDiff(args []string, tool string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	local, err := getCurrentLocal(cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 1 {
+		return fmt.Errorf("usage: gs diff [path]")
+	}
+	paths, err := resolveLocalPaths(local, args, false)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp("", "gs-diff-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	rel := ""
+	if len(paths) > 0 {
+		rel = paths[0]
+	}
+	localPath := filepath.Join(local.Path, filepath.FromSlash(rel))
+	info, err := os.Stat(localPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	localDir := err == nil && info.IsDir()
+
+	if tool != "" {
+		logProgress("fetching remote version of '%s'...", displayPath(local, rel))
+		if err := fetchRemote(cfg, local, []string{orDot(rel)}, tmp); err != nil {
+			return err
+		}
+		return runDiffTool(tool, existingOrNull(localPath), existingOrNull(filepath.Join(tmp, filepath.FromSlash(rel))))
+	}
+
+	if rel == "" || localDir {
+		return diffSummary(cfg, local, paths, tmp)
+	}
+
+	logProgress("fetching remote version of '%s'...", rel)
+	if err := fetchRemote(cfg, local, paths, tmp); err != nil {
+		return err
+	}
+	remotePath := filepath.Join(tmp, filepath.FromSlash(rel))
+	if info, err := os.Stat(remotePath); err == nil && info.IsDir() {
+		// only a directory on the remote, summarize what's in it
+		return diffSummary(cfg, local, paths, tmp)
+	}
+
+	return diffFile(rel, localPath, remotePath)
+}
+
+func orDot(rel string) string {
+	if rel == "" {
+		return "."
+	}
+
+	return rel
+}
+
+func displayPath(local *Local, rel string) string {
+	if rel == "" {
+		return local.Name
+	}
+
+	return rel
+}
+
+func existingOrNull(path string) string {
+	if _, err := os.Stat(path); err != nil {
+		return os.DevNull
+	}
+
+	return path
+}
+
+// diffFile compares a single file, either side of which may be missing; like
+// the summary it shows what a push would change, i.e. remote to local
+func diffFile(rel, localPath, remotePath string) error {
+	localInfo, localErr := os.Stat(localPath)
+	remoteInfo, remoteErr := os.Stat(remotePath)
+	switch {
+	case localErr != nil && remoteErr != nil:
+		return fmt.Errorf("'%s' exists neither locally nor on the remote", rel)
+	case localErr != nil:
+		logSuccess("'%s' only exists on the remote", rel)
+	case remoteErr != nil:
+		logSuccess("'%s' only exists locally", rel)
+	}
+
+	binary := false
+	for _, p := range []string{localPath, remotePath} {
+		if b, err := isBinaryFile(p); err == nil && b {
+			binary = true
+		}
+	}
+
+	if binary {
+		logSuccess("binary file '%s':", rel)
+		for _, side := range []struct {
+			name string
+			path string
+			info fs.FileInfo
+		}{{"local", localPath, localInfo}, {"remote", remotePath, remoteInfo}} {
+			if side.info == nil {
+				fmt.Printf("  %-7s missing\n", side.name)
+				continue
+			}
+			sum, err := hashFile(side.path)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("  %-7s %8s  sha256:%s\n", side.name, formatSize(side.info.Size()), sum)
+		}
+		return nil
+	}
+
+	differs, err := unifiedDiff(os.Stdout, existingOrNull(remotePath), existingOrNull(localPath), "remote/"+rel, "local/"+rel)
+	if err != nil {
+		return err
+	}
+	if !differs {
+		logSuccess("'%s' is identical on both sides", rel)
+	}
+
+	return nil
+}
+
+// diffSummary lists the files that differ, with line counts for modified text
+// files; the file list comes from the same dry runs 'gs status' uses
+func diffSummary(cfg *Config, local *Local, paths []string, tmp string) error {
+	pushChanges, _, err := statusChanges(cfg, local, syncOptions{Paths: paths})
+	if errors.Is(err, ErrRemoteNotFound) {
+		logWarn("remote directory does not exist yet")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var modified []string
+	for _, c := range pushChanges {
+		if isDestructive(c) && !isDeletion(c) {
+			modified = append(modified, changePath(c))
+		}
+	}
+	if len(modified) > 0 {
+		logProgress("fetching %d remote file(s)...", len(modified))
+		if err := fetchRemote(cfg, local, modified, tmp); err != nil {
+			return err
+		}
+	}
+
+	var lines []string
+	for _, c := range pushChanges {
+		rel := changePath(c)
+		if strings.HasSuffix(rel, "/") {
+			continue
+		}
+		switch {
+		case isDeletion(c):
+			lines = append(lines, fmt.Sprintf("D  %s  (remote only)", rel))
+		case isNewItem(c):
+			lines = append(lines, fmt.Sprintf("A  %s  (local only)", rel))
+		case isDestructive(c):
+			lines = append(lines, "M  "+rel+"  "+describeModification(local, rel, tmp))
+		}
+	}
+
+	if len(lines) == 0 {
+		logSuccess("no differences")
+		return nil
+	}
+
+	logSuccess("differences for '%s'%s (local vs remote):", local.Name, describePaths(paths))
+	for _, l := range lines {
+		fmt.Printf("  %s\n", l)
+	}
+
+	return nil
+}
+
+func describeModification(local *Local, rel, tmp string) string {
+	localPath := filepath.Join(local.Path, filepath.FromSlash(rel))
+	remotePath := filepath.Join(tmp, filepath.FromSlash(rel))
+
+	localInfo, err := os.Stat(localPath)
+	if err != nil {
+		return "(unreadable)"
+	}
+	remoteInfo, err := os.Stat(remotePath)
+	if err != nil {
+		return "(remote version unavailable)"
+	}
+
+	lb, _ := isBinaryFile(localPath)
+	rb, _ := isBinaryFile(remotePath)
+	if lb || rb {
+		return fmt.Sprintf("(binary, %s local, %s remote)", formatSize(localInfo.Size()), formatSize(remoteInfo.Size()))
+	}
+
+	added, removed, err := diffStat(remotePath, localPath)
+	if err != nil {
+		return "(" + err.Error() + ")"
+	}
+	if added == 0 && removed == 0 {
+		return "(same content, timestamps differ)"
+	}
+
+	return fmt.Sprintf("(+%d -%d)", added, removed)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileID isn't supported here, so journald is never used
+func fileID(f *os.File) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// locals with 'git = true' are treated as git repositories: files git ignores
+// are excluded, pushes are refused in the middle of a rebase or merge, and
+// with 'sync_git_dir = true' the .git directory is synced too, but only while
+// the repository is clean and no git command is running
+
+type gitState struct {
+	repo      bool     // the local is (inside) a repository
+	operation string   // rebase, merge etc. in progress
+	busy      bool     // a git command holds the index lock
+	changed   []string // tracked files with uncommitted changes
+	untracked []string // untracked files and directories (with a trailing '/')
+	ignored   []string // exclude patterns for files git ignores
+}
+
+// clean reports whether .git can be synced, i.e. it won't change while it's
+// transferred and matches the working tree
+func (s *gitState) clean() bool {
+	return s.operation == "" && !s.busy && len(s.changed) == 0
+}
+
+// gitStatus inspects the local's repository once; the result is cached until
+// a pull changes it
+func (l *Local) gitStatus() *gitState {
+	if l.git == nil {
+		state, err := inspectGit(l.Path)
+		if err != nil {
+			logWarn("failed to inspect git repository of '%s': %s", l.Name, err)
+			state = &gitState{}
+		}
+		l.git = state
+	}
+
+	return l.git
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(output), nil
+}
+
+// markers git leaves in its directory while an operation is unfinished
+var gitOperations = []struct{ marker, operation string }{
+	{"rebase-merge", "rebase"},
+	{"rebase-apply", "rebase"},
+	{"MERGE_HEAD", "merge"},
+	{"CHERRY_PICK_HEAD", "cherry-pick"},
+	{"REVERT_HEAD", "revert"},
+}
+
+func inspectGit(dir string) (*gitState, error) {
+	state := &gitState{}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return state, nil // nothing pulled yet
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git is not installed")
+	}
+
+	output, err := git(dir, "rev-parse", "--absolute-git-dir", "--show-prefix")
+	if err != nil {
+		// not a repository (yet), e.g. before .git is pulled
+		return state, nil
+	}
+	lines := strings.Split(output, "\n")
+	gitDir, prefix := lines[0], ""
+	if len(lines) > 1 {
+		prefix = lines[1]
+	}
+	state.repo = true
+
+	for _, op := range gitOperations {
+		if _, err := os.Stat(filepath.Join(gitDir, op.marker)); err == nil {
+			state.operation = op.operation
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "index.lock")); err == nil {
+		state.busy = true
+	}
+
+	status, err := git(dir, "status", "--porcelain", "-z", "--", ".")
+	if err != nil {
+		return nil, err
+	}
+	state.changed, state.untracked = parseGitStatus(status, prefix)
+
+	ignored, err := git(dir, "ls-files", "--others", "--ignored", "--exclude-standard", "--directory", "-z")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range strings.Split(ignored, "\x00") {
+		if p != "" {
+			state.ignored = append(state.ignored, "/"+escapePattern(p))
+		}
+	}
+
+	return state, nil
+}
+
+// parseGitStatus splits 'git status --porcelain -z' output into changed and
+// untracked paths, made relative to the local by removing prefix
+func parseGitStatus(output, prefix string) (changed, untracked []string) {
+	entries := strings.Split(output, "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		code, p := entry[:2], strings.TrimPrefix(entry[3:], prefix)
+		if code[0] == 'R' || code[0] == 'C' {
+			i++ // the original path of a rename or copy follows
+		}
+
+		if code == "??" {
+			untracked = append(untracked, p)
+		} else {
+			changed = append(changed, p)
+		}
+	}
+
+	return changed, untracked
+}
+
+// escapePattern makes a path match itself literally as an exclude pattern
+func escapePattern(p string) string {
+	if !strings.ContainsAny(p, "*?[") {
+		return p
+	}
+
+	var b strings.Builder
+	for _, r := range p {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// gitExcludes adjusts the excludes of a git local: the .git directory is
+// only left out while it can't be synced, and files git ignores are added
+func gitExcludes(l *Local, excludes []string) []string {
+	state := l.gitStatus()
+	syncDir := l.SyncGitDir && state.clean()
+
+	excludes = slices.DeleteFunc(excludes, func(pattern string) bool {
+		return strings.Trim(pattern, "/") == ".git"
+	})
+	if !syncDir {
+		excludes = append(excludes, ".git")
+	}
+
+	return append(excludes, state.ignored...)
+}
+
+// checkGitPush refuses to push a repository in the middle of an operation,
+// whose working tree is neither the old nor the new state
+func checkGitPush(l *Local) error {
+	state := l.gitStatus()
+	if state.operation != "" {
+		logSuccess("finish or abort the %s first", state.operation)
+		return fmt.Errorf("push aborted: '%s' is in the middle of a %s", l.Name, state.operation)
+	}
+	if l.SyncGitDir && !state.clean() {
+		logWarn("'%s' has uncommitted changes, .git won't be synced this time", l.Name)
+	}
+
+	return nil
+}
+
+// warnUncommitted warns about uncommitted changes a pull plan would overwrite
+func warnUncommitted(l *Local, changes []string) {
+	state := l.gitStatus()
+	if l.SyncGitDir && state.repo && !state.clean() {
+		logWarn("'%s' has uncommitted changes, .git won't be synced this time", l.Name)
+	}
+
+	dirty := append(slices.Clone(state.changed), state.untracked...)
+	var overwritten []string
+	for _, c := range changes {
+		p := changePath(c)
+		for _, d := range dirty {
+			if p == d || (strings.HasSuffix(d, "/") && strings.HasPrefix(p, d)) {
+				overwritten = append(overwritten, c)
+				break
+			}
+		}
+	}
+	if len(overwritten) == 0 {
+		return
+	}
+
+	logWarn("the pull would overwrite uncommitted changes in git:")
+	for _, c := range overwritten {
+		fmt.Printf("  %s\n", describeChange(c))
+	}
+}
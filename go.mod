@@ -3,3 +3,8 @@ module github.com/200ug/gs
 go 1.24.2
 
 require github.com/BurntSushi/toml v1.6.0
+
+require (
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0 // indirect
+)
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestParseRemote(t *testing.T) {
@@ -79,6 +95,7 @@ func TestRemoteForLocal(t *testing.T) {
 	}{
 		{&Local{Name: "notes", Path: "/home/user/notes"}, "user@host:/srv/sync/notes"},
 		{&Local{Name: "projects", Path: "/home/user/projects"}, "user@host:/srv/sync/projects"},
+		{&Local{Name: "work-pdfs", Path: "/home/user/work/pdfs", RemoteSubdir: "work/pdfs"}, "user@host:/srv/sync/work/pdfs"},
 	}
 
 	for _, tt := range tests {
@@ -198,6 +215,57 @@ func TestAddLocal(t *testing.T) {
 		}
 	})
 
+	t.Run("parent path rejected", func(t *testing.T) {
+		cfg := &Config{
+			Locals: []Local{{Name: "notes", Path: "/home/user/notes"}},
+		}
+		err := cfg.AddLocal("user", "/home/user")
+		if err == nil {
+			t.Error("AddLocal() expected error for parent path, got none")
+		}
+	})
+
+	t.Run("same basename with custom remote subdir", func(t *testing.T) {
+		cfg := &Config{
+			Locals: []Local{{Name: "pdfs", Path: "/home/user/documents/pdfs"}},
+		}
+		err := cfg.addLocal(Local{Name: "notes-pdfs", Path: "/home/user/notes/pdfs", RemoteSubdir: "notes/pdfs"})
+		if err != nil {
+			t.Fatalf("addLocal() unexpected error: %v", err)
+		}
+	})
+
+	t.Run("overlapping remote dir rejected", func(t *testing.T) {
+		cfg := &Config{
+			Locals: []Local{{Name: "notes", Path: "/home/user/notes"}},
+		}
+		for _, subdir := range []string{"notes", "notes/pdfs"} {
+			err := cfg.addLocal(Local{Name: "other", Path: "/home/user/other", RemoteSubdir: subdir})
+			if err == nil {
+				t.Errorf("addLocal() expected error for remote subdir %q, got none", subdir)
+			}
+		}
+	})
+
+	t.Run("invalid name rejected", func(t *testing.T) {
+		cfg := &Config{}
+		for _, name := range []string{"", ".", "..", "a/b", `a\b`} {
+			if err := cfg.addLocal(Local{Name: name, Path: "/home/user/other"}); err == nil {
+				t.Errorf("addLocal() expected error for name %q, got none", name)
+			}
+		}
+	})
+
+	t.Run("invalid remote subdir rejected", func(t *testing.T) {
+		cfg := &Config{}
+		for _, subdir := range []string{"/abs", "../up", "a/../b", "a/"} {
+			err := cfg.addLocal(Local{Name: "other", Path: "/home/user/other", RemoteSubdir: subdir})
+			if err == nil {
+				t.Errorf("addLocal() expected error for remote subdir %q, got none", subdir)
+			}
+		}
+	})
+
 	t.Run("subpath rejected", func(t *testing.T) {
 		cfg := &Config{
 			Locals: []Local{{Name: "notes", Path: "/home/user/notes"}},
@@ -247,3 +315,1838 @@ func TestRemoveLocal(t *testing.T) {
 	})
 }
 
+func TestConfigKeys(t *testing.T) {
+	newCfg := func() *Config {
+		return &Config{
+			Server:     "user@host",
+			Port:       "22",
+			RemotePath: "/srv/sync",
+			Excludes:   []string{".git"},
+			Locals:     []Local{{Name: "notes", Path: "/home/user/notes"}},
+		}
+	}
+
+	t.Run("get top-level", func(t *testing.T) {
+		keys, err := newCfg().GetKey("excludes")
+		if err != nil {
+			t.Fatalf("GetKey() unexpected error: %v", err)
+		}
+		if len(keys) != 1 || keys[0].Value != `[".git"]` {
+			t.Errorf("GetKey(excludes) = %v, want [\".git\"]", keys)
+		}
+	})
+
+	t.Run("set local excludes", func(t *testing.T) {
+		cfg := newCfg()
+		if err := cfg.SetKey("locals.notes.excludes", `["*.bak"]`); err != nil {
+			t.Fatalf("SetKey() unexpected error: %v", err)
+		}
+		if got := cfg.Locals[0].Excludes; len(got) != 1 || got[0] != "*.bak" {
+			t.Errorf("local excludes = %v, want [*.bak]", got)
+		}
+	})
+
+	t.Run("set bare string", func(t *testing.T) {
+		cfg := newCfg()
+		if err := cfg.SetKey("port", "2222"); err != nil {
+			t.Fatalf("SetKey() unexpected error: %v", err)
+		}
+		if cfg.Port != "2222" {
+			t.Errorf("port = %q, want 2222", cfg.Port)
+		}
+	})
+
+	t.Run("invalid keys rejected", func(t *testing.T) {
+		cfg := newCfg()
+		for _, key := range []string{"", "nope", "locals", "locals.other.path", "port.sub"} {
+			if err := cfg.SetKey(key, `"x"`); err == nil {
+				t.Errorf("SetKey(%q) expected error, got none", key)
+			}
+		}
+		if err := cfg.SetKey("excludes", "not a list"); err == nil {
+			t.Error("SetKey(excludes) expected error for non-list value, got none")
+		}
+	})
+
+	t.Run("keys with own commands rejected", func(t *testing.T) {
+		cfg := newCfg()
+		for _, key := range []string{"locals.notes.name", "locals.notes.path", "locals.notes.remote_subdir"} {
+			if err := cfg.SetKey(key, `"x"`); err == nil {
+				t.Errorf("SetKey(%q) expected error, got none", key)
+			}
+			if err := cfg.UnsetKey(key); err == nil {
+				t.Errorf("UnsetKey(%q) expected error, got none", key)
+			}
+		}
+		if cfg.Locals[0].Name != "notes" || cfg.Locals[0].Path != "/home/user/notes" {
+			t.Errorf("local changed to %+v", cfg.Locals[0])
+		}
+	})
+
+	t.Run("keys with own commands rejected in edits", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			modify  func(*Config)
+			wantErr bool
+		}{
+			{"excludes", func(c *Config) { c.Locals[0].Excludes = []string{"*.bak"} }, false},
+			{"new local", func(c *Config) { c.Locals = append(c.Locals, Local{Name: "docs", Path: "/home/user/docs"}) }, false},
+			{"removed local", func(c *Config) { c.Locals = nil }, false},
+			{"name", func(c *Config) { c.Locals[0].Name = "notebook" }, true},
+			{"path", func(c *Config) { c.Locals[0].Path = "/home/user/notebook" }, true},
+			{"remote_subdir", func(c *Config) { c.Locals[0].RemoteSubdir = "archive/notes" }, true},
+		}
+
+		for _, tt := range tests {
+			before, after := newCfg(), newCfg()
+			tt.modify(after)
+			if err := checkCommandKeys(before, after); (err != nil) != tt.wantErr {
+				t.Errorf("%s: checkCommandKeys() = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		}
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		cfg := newCfg()
+		if err := cfg.UnsetKey("excludes"); err != nil {
+			t.Fatalf("UnsetKey() unexpected error: %v", err)
+		}
+		if cfg.Excludes != nil {
+			t.Errorf("excludes = %v, want nil", cfg.Excludes)
+		}
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{"valid", func(c *Config) {}, false},
+		{"missing server", func(c *Config) { c.Server = "" }, true},
+		{"bad port", func(c *Config) { c.Port = "ssh" }, true},
+		{"relative remote path", func(c *Config) { c.RemotePath = "srv/sync" }, true},
+		{"duplicate name", func(c *Config) { c.Locals[1].Name = "notes" }, true},
+		{"nested paths", func(c *Config) { c.Locals[1].Path = "/home/user/notes/sub" }, true},
+		{"relative local path", func(c *Config) { c.Locals[1].Path = "projects" }, true},
+		{"dot dot name", func(c *Config) { c.Locals[1].Name = ".." }, true},
+		{"encrypt names without encrypt", func(c *Config) { c.Locals[0].EncryptNames = true }, true},
+		{"checksum with encrypt", func(c *Config) { c.Locals[0].Encrypt = true; c.Locals[0].Checksum = true }, true},
+		{"bwlimit", func(c *Config) { c.BwLimit = "1.5M"; c.Locals[0].BwLimit = "500" }, false},
+		{"bad bwlimit", func(c *Config) { c.BwLimit = "fast" }, true},
+		{"bad local bwlimit", func(c *Config) { c.Locals[0].BwLimit = "2 MB" }, true},
+		{"metered policy", func(c *Config) { c.Metered = Metered{Policy: "defer", MaxSize: "20M"} }, false},
+		{"bad metered policy", func(c *Config) { c.Metered.Policy = "sometimes" }, true},
+		{"bad metered size", func(c *Config) { c.Metered = Metered{Policy: "skip", MaxSize: "big"} }, true},
+		{"notifiers", func(c *Config) {
+			c.Notifiers = []Notifier{{Name: "desktop", Type: "desktop"}, {Name: "hook", Type: "webhook", URL: "https://example.com/gs", Events: []string{"failure"}}}
+		}, false},
+		{"notifier without name", func(c *Config) { c.Notifiers = []Notifier{{Type: "desktop"}} }, true},
+		{"duplicate notifier", func(c *Config) { c.Notifiers = []Notifier{{Name: "a", Type: "desktop"}, {Name: "a", Type: "desktop"}} }, true},
+		{"bad notifier url", func(c *Config) { c.Notifiers = []Notifier{{Name: "hook", Type: "webhook", URL: "example.com"}} }, true},
+		{"bad notifier event", func(c *Config) {
+			c.Notifiers = []Notifier{{Name: "cmd", Type: "command", Command: "true", Events: []string{"started"}}}
+		}, true},
+		{"negative max_deletions", func(c *Config) { c.MaxDeletions = -1 }, true},
+		{"mode", func(c *Config) { c.Locals[0].Mode = "mirror-pull"; c.Locals[1].Mode = "append-only" }, false},
+		{"bad mode", func(c *Config) { c.Locals[0].Mode = "read-only" }, true},
+		{"metadata policies", func(c *Config) {
+			c.Locals[0].Symlinks = "follow"
+			c.Locals[0].Perms = "normalize"
+			c.Locals[1].Perms = "normalize"
+			c.Locals[1].Chmod = "Du=rwx,go=rx,Fu=rw,go=r"
+		}, false},
+		{"bad symlinks policy", func(c *Config) { c.Locals[0].Symlinks = "copy" }, true},
+		{"bad perms policy", func(c *Config) { c.Locals[0].Perms = "0644" }, true},
+		{"chmod without normalize", func(c *Config) { c.Locals[0].Chmod = "F644" }, true},
+		{"bad chmod", func(c *Config) { c.Locals[0].Perms = "normalize"; c.Locals[0].Chmod = "F644,rw" }, true},
+		{"file sizes", func(c *Config) { c.WarnFileSize = "100M"; c.Locals[0].MaxFileSize = "1.5G" }, false},
+		{"bad warn_file_size", func(c *Config) { c.WarnFileSize = "huge" }, true},
+		{"bad max_file_size", func(c *Config) { c.Locals[0].MaxFileSize = "-1M" }, true},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{
+			Server:     "user@host",
+			Port:       "22",
+			RemotePath: "/srv/sync",
+			Locals: []Local{
+				{Name: "notes", Path: "/home/user/notes"},
+				{Name: "projects", Path: "/home/user/projects"},
+			},
+		}
+		tt.modify(cfg)
+		err := validateConfig(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateConfig() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSaveConfigPreservesLayout(t *testing.T) {
+	configOverride = filepath.Join(t.TempDir(), "gs.toml")
+	t.Cleanup(func() { configOverride = "" })
+
+	original := `# synced devices
+
+remote_path = "/srv/sync"
+server = "user@host"
+# ssh port
+port = "22"
+added_later = true
+
+[[locals]]
+name = "notes"
+path = "/home/user/notes"
+[locals.future]
+enabled = true
+`
+	if err := writeConfigFile([]byte(original)); err != nil {
+		t.Fatalf("writeConfigFile() unexpected error: %v", err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() unexpected error: %v", err)
+	}
+	if err := cfg.AddLocal("docs", "/home/user/docs"); err != nil {
+		t.Fatalf("AddLocal() unexpected error: %v", err)
+	}
+	if err := saveConfig(cfg); err != nil {
+		t.Fatalf("saveConfig() unexpected error: %v", err)
+	}
+
+	want := `# synced devices
+
+remote_path = "/srv/sync"
+server = "user@host"
+# ssh port
+port = "22"
+added_later = true
+
+[[locals]]
+name = "notes"
+path = "/home/user/notes"
+
+[locals.future]
+enabled = true
+
+[[locals]]
+name = "docs"
+path = "/home/user/docs"
+`
+	got, err := os.ReadFile(configPath())
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("saved config =\n%s\nwant\n%s", got, want)
+	}
+
+	backup, err := os.ReadFile(configPath() + ".bak")
+	if err != nil {
+		t.Fatalf("failed to read backup: %v", err)
+	}
+	if string(backup) != original {
+		t.Errorf("backup =\n%s\nwant\n%s", backup, original)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GS_CONFIG", "")
+	t.Setenv("GS_PROFILE", "")
+	t.Cleanup(func() { configOverride, configProfile = "", "" })
+
+	tests := []struct {
+		name  string
+		setup func()
+		want  string
+	}{
+		{"default", func() {}, filepath.Join(home, ".config", "gs", "gs.toml")},
+		{"xdg", func() { t.Setenv("XDG_CONFIG_HOME", "/xdg") }, "/xdg/gs/gs.toml"},
+		{"relative xdg ignored", func() { t.Setenv("XDG_CONFIG_HOME", "xdg") }, filepath.Join(home, ".config", "gs", "gs.toml")},
+		{"profile env", func() { t.Setenv("GS_PROFILE", "work") }, filepath.Join(home, ".config", "gs", "profiles", "work.toml")},
+		{"profile flag", func() { t.Setenv("GS_PROFILE", "work"); configProfile = "home" }, filepath.Join(home, ".config", "gs", "profiles", "home.toml")},
+		{"config env", func() { t.Setenv("GS_PROFILE", "work"); t.Setenv("GS_CONFIG", "/etc/gs.toml") }, "/etc/gs.toml"},
+		{"profile flag over config env", func() { configProfile = "home"; t.Setenv("GS_CONFIG", "/etc/gs.toml") }, filepath.Join(home, ".config", "gs", "profiles", "home.toml")},
+		{"config flag", func() { t.Setenv("GS_CONFIG", "/etc/gs.toml"); configOverride = "~/ci.toml" }, filepath.Join(home, "ci.toml")},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("XDG_CONFIG_HOME", "")
+		t.Setenv("GS_CONFIG", "")
+		t.Setenv("GS_PROFILE", "")
+		configOverride, configProfile = "", ""
+		tt.setup()
+		if got := configPath(); got != tt.want {
+			t.Errorf("%s: configPath() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseGlobalFlags(t *testing.T) {
+	t.Setenv("GS_PROFILE", "")
+	t.Cleanup(func() {
+		configOverride, configProfile = "", ""
+		logOptions.Level, logOptions.Verbose, logOptions.Quiet, logOptions.File = "", false, false, ""
+	})
+
+	tests := []struct {
+		args        []string
+		wantArgs    []string
+		wantConfig  string
+		wantProfile string
+		shouldError bool
+	}{
+		{[]string{"push", "--force"}, []string{"push", "--force"}, "", "", false},
+		{[]string{"--config", "/tmp/gs.toml", "push"}, []string{"push"}, "/tmp/gs.toml", "", false},
+		{[]string{"--profile=work", "status"}, []string{"status"}, "", "work", false},
+		{[]string{"--help"}, []string{"--help"}, "", "", false},
+		{[]string{"-h"}, []string{"-h"}, "", "", false},
+		{[]string{"-v", "--log-level", "debug", "--profile", "work", "auto"}, []string{"auto"}, "", "work", false},
+		{[]string{"-q", "--log-file=/tmp/gs.log", "auto", "--interval", "1m"}, []string{"auto", "--interval", "1m"}, "", "", false},
+		{[]string{"push", "--profile", "work", "--force", "notes"}, []string{"push", "--force", "notes"}, "", "work", false},
+		{[]string{"push", "--", "--profile"}, []string{"push", "--", "--profile"}, "", "", false},
+		{[]string{"--config"}, nil, "", "", true},
+		{[]string{"--log-level"}, nil, "", "", true},
+		{[]string{"--profile", "../x", "push"}, nil, "", "", true},
+		{[]string{"--config", "a.toml", "--profile", "work", "push"}, nil, "", "", true},
+	}
+
+	for _, tt := range tests {
+		configOverride, configProfile = "", ""
+		args, err := parseGlobalFlags(tt.args)
+		if tt.shouldError {
+			if err == nil {
+				t.Errorf("parseGlobalFlags(%q) expected error, got none", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGlobalFlags(%q) unexpected error: %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(args, tt.wantArgs) || configOverride != tt.wantConfig || configProfile != tt.wantProfile {
+			t.Errorf("parseGlobalFlags(%q) = (%q, %q, %q), want (%q, %q, %q)",
+				tt.args, args, configOverride, configProfile, tt.wantArgs, tt.wantConfig, tt.wantProfile)
+		}
+	}
+}
+
+func TestParseRemoteDirs(t *testing.T) {
+	output := "4\t0\t0\tempty\n16\t2\t1792357423\tnotes with spaces\n\n"
+	dirs, err := parseRemoteDirs(output)
+	if err != nil {
+		t.Fatalf("parseRemoteDirs() unexpected error: %v", err)
+	}
+	if len(dirs) != 2 {
+		t.Fatalf("expected 2 dirs, got %d", len(dirs))
+	}
+	if dirs[0].Name != "empty" || dirs[0].Size != 4096 || dirs[0].Files != 0 || !dirs[0].Modified.IsZero() {
+		t.Errorf("dirs[0] = %+v, want empty dir of 4096 bytes", dirs[0])
+	}
+	if dirs[1].Name != "notes with spaces" || dirs[1].Files != 2 || dirs[1].Modified.Unix() != 1792357423 {
+		t.Errorf("dirs[1] = %+v, want 'notes with spaces' with 2 files", dirs[1])
+	}
+
+	if _, err := parseRemoteDirs("garbage\n"); err == nil {
+		t.Error("parseRemoteDirs() expected error for malformed line, got none")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0K"},
+		{1536, "1.5K"},
+		{5 * 1024 * 1024, "5.0M"},
+		{3 * 1024 * 1024 * 1024, "3.0G"},
+	}
+
+	for _, tt := range tests {
+		if got := formatSize(tt.bytes); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.bytes, got, tt.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"/srv/sync", "'/srv/sync'"},
+		{"it's", `'it'\''s'`},
+		{"$(rm -rf ~)", "'$(rm -rf ~)'"},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.input); got != tt.want {
+			t.Errorf("shellQuote(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+// fakeSSH puts an ssh on PATH that runs the remote command locally
+func fakeSSH(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor arg; do last=$arg; done\nexec sh -c \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestMakeRemoteParent(t *testing.T) {
+	fakeSSH(t)
+	cfg := &Config{Server: "host", Port: "22", RemotePath: t.TempDir()}
+
+	if err := makeRemoteParent(cfg, "notes/pdfs"); err != nil {
+		t.Fatalf("makeRemoteParent() unexpected error: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(cfg.RemotePath, "notes")); err != nil || !info.IsDir() {
+		t.Errorf("makeRemoteParent() didn't create the parent: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.RemotePath, "notes", "pdfs")); !os.IsNotExist(err) {
+		t.Errorf("makeRemoteParent() created the directory itself: %v", err)
+	}
+	if err := makeRemoteParent(cfg, "docs"); err != nil {
+		t.Errorf("makeRemoteParent() of a top-level directory unexpected error: %v", err)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	devices := parseDevices("== laptop\nnotes\nwork/pdfs\n== desktop\ndocuments\n== old-phone\n")
+	if len(devices) != 3 || len(devices["old-phone"]) != 0 {
+		t.Fatalf("parseDevices() = %v, want 3 devices with old-phone tracking nothing", devices)
+	}
+
+	dirs := []RemoteDir{{Name: "notes"}, {Name: "documents"}, {Name: "work"}, {Name: "music"}, {Name: "notes-old"}}
+	orphans := findOrphans(dirs, devices)
+
+	var names []string
+	for _, o := range orphans {
+		names = append(names, o.Name)
+	}
+	if want := []string{"music", "notes-old"}; !slices.Equal(names, want) {
+		t.Errorf("findOrphans() = %v, want %v", names, want)
+	}
+
+	cfg := &Config{Device: "laptop"}
+	if got := devicesTracking(cfg, devices, "notes"); len(got) != 0 {
+		t.Errorf("devicesTracking(notes) = %v, want none besides this device", got)
+	}
+	if got := devicesTracking(cfg, devices, "documents"); !slices.Equal(got, []string{"desktop"}) {
+		t.Errorf("devicesTracking(documents) = %v, want [desktop]", got)
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	tests := []struct {
+		device string
+		want   string
+	}{
+		{"laptop", "laptop"},
+		{"my laptop/../x", "my_laptop_.._x"},
+		{"..", "unknown"},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{Device: tt.device}
+		if got := cfg.deviceName(); got != tt.want {
+			t.Errorf("deviceName(%q) = %q, want %q", tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestResolveLocalPaths(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file.md"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	local := &Local{Name: "notes", Path: root}
+
+	tests := []struct {
+		args        []string
+		mustExist   bool
+		want        []string
+		shouldError bool
+	}{
+		{[]string{filepath.Join(root, "file.md"), filepath.Join(root, "dir", "sub") + "/"}, true, []string{"file.md", "dir/sub"}, false},
+		{[]string{filepath.Join(root, "dir", "..", "file.md")}, true, []string{"file.md"}, false},
+		{[]string{filepath.Join(root, "dir"), root}, true, nil, false},
+		{[]string{filepath.Join(root, "missing.md")}, false, []string{"missing.md"}, false},
+		{[]string{filepath.Join(root, "missing.md")}, true, nil, true},
+		{[]string{filepath.Dir(root)}, false, nil, true},
+		{[]string{root + "-other/file.md"}, false, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveLocalPaths(local, tt.args, tt.mustExist)
+		if tt.shouldError {
+			if err == nil {
+				t.Errorf("resolveLocalPaths(%q) expected error, got none", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveLocalPaths(%q) unexpected error: %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("resolveLocalPaths(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDescribeChange(t *testing.T) {
+	tests := []struct {
+		change          string
+		wantDesc        string
+		wantDestructive bool
+	}{
+		{">f+++++++++ notes/new.md", "new       notes/new.md", false},
+		{">f.st...... notes/todo.md", "modified  notes/todo.md", true},
+		{"<f..t...... file with spaces.md", "modified  file with spaces.md", true},
+		{"*deleting   old/gone.md", "deleted   old/gone.md", true},
+		{"cd+++++++++ newdir/", "new       newdir/", false},
+		{".d..t...... dir/", "changed   dir/", false},
+		{"cL+++++++++ link -> target", "new       link -> target", false},
+	}
+
+	for _, tt := range tests {
+		if got := describeChange(tt.change); got != tt.wantDesc {
+			t.Errorf("describeChange(%q) = %q, want %q", tt.change, got, tt.wantDesc)
+		}
+		if got := isDestructive(tt.change); got != tt.wantDestructive {
+			t.Errorf("isDestructive(%q) = %v, want %v", tt.change, got, tt.wantDestructive)
+		}
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	patterns := []string{".git", "*.tmp", "build/", "/top.txt", "docs/*.pdf"}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{".git", true, true},
+		{"sub/.git", true, true},
+		{"notes.tmp", false, true},
+		{"deep/nested/file.tmp", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"top.txt", false, true},
+		{"sub/top.txt", false, false},
+		{"docs/a.pdf", false, true},
+		{"sub/docs/a.pdf", false, true},
+		{"docs/a.md", false, false},
+		{"notes.md", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := isExcluded(tt.rel, tt.isDir, patterns); got != tt.want {
+			t.Errorf("isExcluded(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestBaselineLocalModified(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, content string) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("unchanged.md", "a")
+	write("edited.md", "b")
+	write("deleted.md", "c")
+	write("sub/file.md", "d")
+	write("scratch.tmp", "e")
+
+	b, err := snapshotLocal(root, "", []string{"*.tmp"})
+	if err != nil {
+		t.Fatalf("snapshotLocal() unexpected error: %v", err)
+	}
+	if len(b) != 4 {
+		t.Fatalf("snapshotLocal() recorded %d files, want 4 (excludes skipped)", len(b))
+	}
+
+	write("edited.md", "changed")
+	write("created.md", "f")
+	if err := os.Remove(filepath.Join(root, "deleted.md")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"unchanged.md", false},
+		{"sub/file.md", false},
+		{"edited.md", true},
+		{"created.md", true},
+		{"deleted.md", true},
+		{"never-existed.md", false},
+	}
+
+	for _, tt := range tests {
+		if got := b.localModified(root, tt.rel); got != tt.want {
+			t.Errorf("localModified(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"text", []byte("hello\nworld\n"), false},
+		{"utf8", []byte("grüße ✓\n"), false},
+		{"nul byte", []byte("PNG\x00\x01"), true},
+		{"nul past sniff range", append(bytes.Repeat([]byte("a"), binarySniffLen), 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBinary(tt.data); got != tt.want {
+				t.Errorf("isBinary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountDiffLines(t *testing.T) {
+	diff := `--- remote/notes.md
++++ local/notes.md
+@@ -1,3 +1,4 @@
+ unchanged
+-old line
++new line
++another line
+ --- not a header
+`
+	added, removed := countDiffLines(diff)
+	if added != 2 || removed != 1 {
+		t.Errorf("countDiffLines() = +%d -%d, want +2 -1", added, removed)
+	}
+}
+
+func testCipher(names bool) *localCipher {
+	c, err := newLocalCipher(bytes.Repeat([]byte{7}, 32), names)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c := testCipher(false)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 31)
+		}
+
+		var encrypted, decrypted bytes.Buffer
+		if err := c.encrypt(&encrypted, bytes.NewReader(plain)); err != nil {
+			t.Fatalf("encrypt(%d bytes) unexpected error: %v", size, err)
+		}
+		if size >= 16 && bytes.Contains(encrypted.Bytes(), plain) {
+			t.Errorf("encrypt(%d bytes) output contains the plaintext", size)
+		}
+		if err := c.decrypt(&decrypted, bytes.NewReader(encrypted.Bytes())); err != nil {
+			t.Fatalf("decrypt(%d bytes) unexpected error: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("decrypt(encrypt(%d bytes)) doesn't match the plaintext", size)
+		}
+
+		// dropping the final chunk must not go unnoticed
+		if size > chunkSize {
+			truncated := encrypted.Bytes()[:len(fileMagic)+fileSaltLen+chunkSize+chacha20poly1305.Overhead]
+			if err := c.decrypt(io.Discard, bytes.NewReader(truncated)); err == nil {
+				t.Errorf("decrypt() of truncated %d byte file succeeded", size)
+			}
+		}
+	}
+
+	var encrypted bytes.Buffer
+	if err := c.encrypt(&encrypted, strings.NewReader("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testCipher(true).decrypt(io.Discard, bytes.NewReader(encrypted.Bytes())); err != nil {
+		t.Errorf("decrypt() with same key but names enabled failed: %v", err)
+	}
+	other, err := newLocalCipher(bytes.Repeat([]byte{8}, 32), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.decrypt(io.Discard, bytes.NewReader(encrypted.Bytes())); err == nil {
+		t.Error("decrypt() with the wrong key succeeded")
+	}
+}
+
+func TestEncryptPath(t *testing.T) {
+	c := testCipher(true)
+
+	a, err := c.encryptPath("notes/todo.md")
+	if err != nil {
+		t.Fatalf("encryptPath() unexpected error: %v", err)
+	}
+	b, _ := c.encryptPath("notes/todo.md")
+	if a != b {
+		t.Errorf("encryptPath() isn't deterministic: %q != %q", a, b)
+	}
+	if strings.Contains(a, "notes") || strings.Contains(a, "todo") || strings.Count(a, "/") != 1 {
+		t.Errorf("encryptPath() = %q, want two encrypted elements", a)
+	}
+
+	dir, _ := c.encryptPath("notes/")
+	if !strings.HasSuffix(dir, "/") || !strings.HasPrefix(a, dir) {
+		t.Errorf("encryptPath(\"notes/\") = %q, want prefix of %q with trailing slash", dir, a)
+	}
+
+	for _, p := range []string{"notes/todo.md", "notes/", ".", keyParamsFile} {
+		enc, err := c.encryptPath(p)
+		if err != nil {
+			t.Fatalf("encryptPath(%q) unexpected error: %v", p, err)
+		}
+		if got, err := c.decryptPath(enc); err != nil || got != p {
+			t.Errorf("decryptPath(encryptPath(%q)) = %q, %v", p, got, err)
+		}
+	}
+
+	if _, err := c.decryptPath("plain-name.md"); err == nil {
+		t.Error("decryptPath() of an unencrypted name succeeded")
+	}
+	if _, err := c.encryptName(strings.Repeat("x", 200)); err == nil {
+		t.Error("encryptName() of a 200 byte name succeeded")
+	}
+	if got, _ := testCipher(false).encryptPath("notes/todo.md"); got != "notes/todo.md" {
+		t.Errorf("encryptPath() without name encryption = %q, want unchanged", got)
+	}
+
+	changes := c.decryptChanges([]string{">f+++++++++ " + a, "*deleting   " + dir})
+	want := []string{">f+++++++++ notes/todo.md", "*deleting   notes/"}
+	if !slices.Equal(changes, want) {
+		t.Errorf("decryptChanges() = %q, want %q", changes, want)
+	}
+}
+
+func TestCleanStagingKeepsPartialDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, rel := range []string{"kept", "stale", partialDir + "/a", "sub/" + partialDir + "/b"} {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cleanStaging(dir, stagingManifest{"kept": {Path: "kept"}}); err != nil {
+		t.Fatalf("cleanStaging() unexpected error: %v", err)
+	}
+	for rel, want := range map[string]bool{"kept": true, "stale": false, partialDir + "/a": true, "sub/" + partialDir + "/b": true} {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel)))
+		if got := err == nil; got != want {
+			t.Errorf("cleanStaging() left %s = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestDecryptTreeSkipsPartialDirs(t *testing.T) {
+	c := testCipher(false)
+	src, dst := t.TempDir(), t.TempDir()
+
+	var encrypted bytes.Buffer
+	if err := c.encrypt(&encrypted, strings.NewReader("done")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "notes", partialDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(src, "notes", "a.md"), encrypted.Bytes(), 0644)
+	os.WriteFile(filepath.Join(src, "notes", partialDir, "b.md"), encrypted.Bytes()[:10], 0644)
+
+	if err := decryptTree(c, src, dst); err != nil {
+		t.Fatalf("decryptTree() unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "notes", "a.md")); err != nil || string(data) != "done" {
+		t.Errorf("decryptTree() wrote %q, %v, want \"done\"", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "notes", partialDir)); !os.IsNotExist(err) {
+		t.Errorf("decryptTree() decrypted the partial dir: %v", err)
+	}
+}
+
+func TestStaging(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("GS_CONFIG", filepath.Join(t.TempDir(), "gs.toml"))
+
+	root := t.TempDir()
+	write := func(rel, content string) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("todo.md", "buy milk")
+	write("sub/plan.md", "world domination")
+	write("scratch.tmp", "excluded")
+
+	cfg := &Config{Excludes: []string{"*.tmp"}}
+	local := &Local{Name: "notes", Path: root, Encrypt: true, EncryptNames: true, cipher: testCipher(true)}
+
+	if err := stageLocal(cfg, local); err != nil {
+		t.Fatalf("stageLocal() unexpected error: %v", err)
+	}
+	staged, err := snapshotLocal(stagingDir(local), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 2 {
+		t.Fatalf("stageLocal() staged %d files, want 2 (excludes skipped)", len(staged))
+	}
+	for rel := range staged {
+		if strings.Contains(rel, "todo") || strings.Contains(rel, "sub") {
+			t.Errorf("staged path %q isn't encrypted", rel)
+		}
+	}
+
+	// simulate a pull bringing a new version of todo.md and deleting plan.md
+	m, err := loadManifest(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := filepath.Join(t.TempDir(), "todo.md")
+	if err := os.WriteFile(update, []byte("buy oat milk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := transformFile(update, filepath.Join(stagingDir(local), m["todo.md"].Path), local.cipher.encrypt); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(stagingDir(local), m["sub/plan.md"].Path)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unstageLocal(cfg, local); err != nil {
+		t.Fatalf("unstageLocal() unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "todo.md")); string(data) != "buy oat milk" {
+		t.Errorf("todo.md = %q after unstaging, want the pulled version", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub", "plan.md")); !os.IsNotExist(err) {
+		t.Errorf("sub/plan.md still exists after its staged copy was deleted")
+	}
+	if _, err := os.Stat(filepath.Join(root, "scratch.tmp")); err != nil {
+		t.Errorf("excluded scratch.tmp was touched: %v", err)
+	}
+
+	// nothing changed locally, so restaging must not re-encrypt anything
+	before, _ := snapshotLocal(stagingDir(local), "", nil)
+	if err := stageLocal(cfg, local); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := snapshotLocal(stagingDir(local), "", nil)
+	if !maps.Equal(before, after) {
+		t.Errorf("stageLocal() changed the staging directory without local changes")
+	}
+}
+
+func TestParseHashList(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+	output := a + "  ./notes/todo.md\n" +
+		b + " *./binary.bin\n" +
+		`\` + a + `  ./odd\nname\\x` + "\n"
+
+	got, err := parseHashList(output)
+	if err != nil {
+		t.Fatalf("parseHashList() unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"notes/todo.md": a,
+		"binary.bin":    b,
+		"odd\nname\\x":  a,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseHashList() = %q, want %q", got, want)
+	}
+
+	if _, err := parseHashList("garbage\n"); err == nil {
+		t.Error("parseHashList() of invalid output succeeded")
+	}
+}
+
+func TestCompareHashes(t *testing.T) {
+	local := map[string]string{"same": "1", "changed": "2", "new": "3"}
+	remote := map[string]string{"same": "1", "changed": "9", "gone": "4"}
+
+	got := compareHashes(local, remote)
+	want := []hashMismatch{
+		{"changed", "differs"},
+		{"gone", "remote only"},
+		{"new", "local only"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("compareHashes() = %v, want %v", got, want)
+	}
+}
+
+func TestParseItemizedChanges(t *testing.T) {
+	output := `sending incremental file list
+created directory /srv/sync/notes
+cd+++++++++ sub/
+>f+++++++++ sub/new.md
+<f.st...... todo.md
+*deleting   old.md
+.d..t...... ./
+
+sent 1,234 bytes  received 56 bytes  2,580.00 bytes/sec
+`
+	got := parseItemizedChanges(output)
+	want := []string{"cd+++++++++ sub/", ">f+++++++++ sub/new.md", "<f.st...... todo.md", "*deleting   old.md"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseItemizedChanges() = %q, want %q", got, want)
+	}
+}
+
+func TestParseRemoteStates(t *testing.T) {
+	got, err := parseRemoteStates("12 1700000000 ./notes/todo.md\n0 1700000001 ./with space.md\n")
+	if err != nil {
+		t.Fatalf("parseRemoteStates() unexpected error: %v", err)
+	}
+	want := map[string]fileState{
+		"notes/todo.md": {Size: 12, ModTime: 1700000000 * 1e9},
+		"with space.md": {Size: 0, ModTime: 1700000001 * 1e9},
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseRemoteStates() = %v, want %v", got, want)
+	}
+
+	if _, err := parseRemoteStates("not a stat line\n"); err == nil {
+		t.Error("parseRemoteStates() of invalid output succeeded")
+	}
+}
+
+func TestHashWithCache(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "hashes.json")
+	var hashed []string
+	hash := func(rels []string) (map[string]string, error) {
+		hashes := make(map[string]string)
+		for _, rel := range rels {
+			hashed = append(hashed, rel)
+			hashes[rel] = "hash-of-" + rel
+		}
+		return hashes, nil
+	}
+
+	states := map[string]fileState{"a": {1, 1}, "b": {2, 2}, "sub/c": {3, 3}}
+	if _, err := hashWithCache(cache, nil, states, hash); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashed) != 3 {
+		t.Fatalf("first run hashed %v, want all files", hashed)
+	}
+
+	hashed = nil
+	states["b"] = fileState{2, 5}
+	delete(states, "sub/c")
+	got, err := hashWithCache(cache, nil, states, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(hashed, []string{"b"}) {
+		t.Errorf("second run hashed %v, want only the modified file", hashed)
+	}
+	if len(got) != 2 {
+		t.Errorf("hashWithCache() returned %d hashes, want 2", len(got))
+	}
+	if _, ok := loadHashCache(cache)["sub/c"]; ok {
+		t.Error("deleted file is still cached")
+	}
+}
+
+func TestCheckTransferAppendOnly(t *testing.T) {
+	fakeSSH(t)
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	cfg := &Config{Server: "host", Port: "22", RemotePath: t.TempDir()}
+	local := &Local{Name: "notes", Path: t.TempDir(), Mode: modeAppendOnly, Verify: true}
+	remote := filepath.Join(cfg.RemotePath, "notes")
+	os.MkdirAll(remote, 0755)
+	os.WriteFile(filepath.Join(local.Path, "a.md"), []byte("same"), 0644)
+	os.WriteFile(filepath.Join(remote, "a.md"), []byte("same"), 0644)
+	os.WriteFile(filepath.Join(remote, "deleted.md"), []byte("kept"), 0644)
+
+	report := &syncReport{Command: "push"}
+	if err := checkTransfer(cfg, local, syncOptions{}, report); err != nil {
+		t.Errorf("checkTransfer() after an append-only push = %v, want nil", err)
+	}
+	if report.Verified == nil || !*report.Verified {
+		t.Errorf("checkTransfer() report verified = %v, want true", report.Verified)
+	}
+
+	local.Mode = ""
+	if err := checkTransfer(cfg, local, syncOptions{}, &syncReport{Command: "push"}); err == nil {
+		t.Error("checkTransfer() with a remote only file expected error, got none")
+	}
+}
+
+func TestVerifyMaxFileSize(t *testing.T) {
+	fakeSSH(t)
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	cfg := &Config{Server: "host", Port: "22", RemotePath: t.TempDir()}
+	local := &Local{Name: "notes", Path: t.TempDir(), MaxFileSize: "10"}
+	remote := filepath.Join(cfg.RemotePath, "notes")
+	trees := map[string]map[string]string{
+		local.Path: {"a.md": "same", "big.bin": "larger than ten bytes"},
+		remote:     {"a.md": "same", "old.bin": "also larger than ten"},
+	}
+	for dir, files := range trees {
+		os.MkdirAll(dir, 0755)
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	mismatches, err := verifyTransfer(cfg, local, nil)
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("verifyTransfer() = %v, %v, want no mismatches", mismatches, err)
+	}
+	localHashes, err := hashTree(local.Path, nil, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteHashes, err := hashRemote(cfg, "notes", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatches := compareHashes(localHashes, remoteHashes); len(mismatches) != 0 {
+		t.Errorf("compareHashes() of trees hashed up to max_file_size = %v, want none", mismatches)
+	}
+
+	local.MaxFileSize = ""
+	if mismatches, _ := verifyTransfer(cfg, local, nil); len(mismatches) != 2 {
+		t.Errorf("verifyTransfer() without max_file_size = %v, want the two large files", mismatches)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"20M", 20 << 20, false},
+		{"20m", 20 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"1.5GiB", 3 << 29, false},
+		{"100KB", 100 << 10, false},
+		{"0", 0, false},
+		{"", 0, true},
+		{"ten", 0, true},
+		{"-5M", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseMeteredProperty(t *testing.T) {
+	tests := []struct {
+		output string
+		want   int
+		ok     bool
+	}{
+		{"u 4\n", 4, true},
+		{"u 1", 1, true},
+		{"(<uint32 3>,)\n", 3, true},
+		{"", 0, false},
+		{"Failed to get property", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseMeteredProperty(tt.output)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseMeteredProperty(%q) = %d, %v, want %d, %v", tt.output, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMeteredHolds(t *testing.T) {
+	tests := []struct {
+		maxSize string
+		size    int64
+		want    bool
+	}{
+		{"", 0, false},
+		{"", 1, true},
+		{"20M", 20 << 20, false},
+		{"20M", 20<<20 + 1, true},
+		{"0", 1, true},
+	}
+
+	for _, tt := range tests {
+		m := Metered{Policy: "defer", MaxSize: tt.maxSize}
+		if got := m.holds(tt.size); got != tt.want {
+			t.Errorf("Metered{MaxSize: %q}.holds(%d) = %v, want %v", tt.maxSize, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestParseRsyncStats(t *testing.T) {
+	output := `
+Number of files: 12 (reg: 10, dir: 2)
+Number of created files: 1 (reg: 1)
+Number of deleted files: 0
+Number of regular files transferred: 3
+Total file size: 1,048,576 bytes
+Total transferred file size: 20,480 bytes
+Literal data: 20,480 bytes
+Total bytes sent: 21,012
+Total bytes received: 1,234
+
+sent 21,012 bytes  received 1,234 bytes  44,492.00 bytes/sec
+`
+	got := parseRsyncStats(output)
+	want := rsyncStats{FilesTransferred: 3, TransferSize: 20480, BytesSent: 21012, BytesReceived: 1234}
+	if got != want {
+		t.Errorf("parseRsyncStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseProgressLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want transferProgress
+		ok   bool
+	}{
+		{"  1,234,567  45%   12.34MB/s    0:00:12 (xfr#3, to-chk=10/20)", transferProgress{Bytes: 1234567, Percent: 45, Rate: "12.34MB/s", ETA: "0:00:12", Done: 10, Total: 20}, true},
+		{"     32,768   3%   31.25kB/s    0:00:31 (xfr#1, ir-chk=1005/1010)", transferProgress{Bytes: 32768, Percent: 3, Rate: "31.25kB/s", ETA: "0:00:31", Done: 5, Total: 1010}, true},
+		{"          0   0%    0.00kB/s    0:00:00", transferProgress{Rate: "0.00kB/s", ETA: "0:00:00"}, true},
+		{">f+++++++++ notes.txt", transferProgress{}, false},
+		{"sending incremental file list", transferProgress{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseProgressLine(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseProgressLine(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader(">f+++++++++ a\n  10  1%  1kB/s  0:00:01\r  20  2%  1kB/s  0:00:01\rdone"))
+	scanner.Split(splitLines)
+
+	var got []string
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	want := []string{">f+++++++++ a", "  10  1%  1kB/s  0:00:01", "  20  2%  1kB/s  0:00:01", "done"}
+	if !slices.Equal(got, want) {
+		t.Errorf("splitLines = %q, want %q", got, want)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"7d", time.Date(2024, 5, 3, 12, 0, 0, 0, time.Local), false},
+		{"2w", time.Date(2024, 4, 26, 12, 0, 0, 0, time.Local), false},
+		{"90m", time.Date(2024, 5, 10, 10, 30, 0, 0, time.Local), false},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), false},
+		{"d", time.Time{}, true},
+		{"-3h", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSince(tt.input, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %v, %v, want %v (error: %v)", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	start := time.Now().Add(-time.Hour)
+	reports := []*syncReport{
+		{Command: "push", Local: "notes", Started: start, Changes: []string{"new       todo.md", "modified  docs/a.txt"}},
+		{Command: "pull", Local: "notes", Started: start.Add(time.Minute), DryRun: true},
+		{Command: "pull", Local: "photos", Started: start.Add(2 * time.Minute), Changes: []string{"deleted   docs/b.jpg"}},
+	}
+	for _, r := range reports {
+		recordHistory(r, nil)
+	}
+
+	entries, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("loadHistory() returned %d entries, want 2 (dry runs aren't recorded)", len(entries))
+	}
+
+	tests := []struct {
+		name   string
+		filter logFilter
+		want   []string // locals of the matching entries
+	}{
+		{"all", logFilter{}, []string{"notes", "photos"}},
+		{"local", logFilter{Local: "photos"}, []string{"photos"}},
+		{"since", logFilter{Since: start.Add(time.Minute)}, []string{"photos"}},
+		{"file", logFilter{File: "todo.md"}, []string{"notes"}},
+		{"directory", logFilter{File: "docs"}, []string{"notes", "photos"}},
+		{"prefix isn't a directory", logFilter{File: "doc"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, entry := range entries {
+				if tt.filter.match(entry) {
+					got = append(got, entry.Local)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("matching locals = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// entries of other configs keep their name
+	other := historyEntry{Time: start, Config: "/elsewhere/gs.toml", Command: "push", Local: "notes", Status: "ok"}
+	if err := appendHistory(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameHistory("notes", "journal"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locals []string
+	for _, entry := range entries {
+		locals = append(locals, entry.Local)
+	}
+	if want := []string{"journal", "photos", "notes"}; !slices.Equal(locals, want) {
+		t.Errorf("locals after rename = %v, want %v", locals, want)
+	}
+	if entries[0].Changes[0] != "new       todo.md" {
+		t.Errorf("renamed entry lost its changes: %+v", entries[0])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "gs.log")
+	f, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n", "seven\n", "eight\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a write that doesn't fit anymore starts a new file, the oldest is dropped
+	want := map[string]string{"": "eight\n", ".1": "six\nseven\n", ".2": "four\nfive\n", ".3": "three\n"}
+	for suffix, content := range want {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v, want %q", filepath.Base(path+suffix), data, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".4"); err == nil {
+		t.Errorf("expected at most %d backups", logBackups)
+	}
+}
+
+func TestIsJournalStream(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dev, ino, ok := fileID(f)
+	if !ok {
+		t.Skip("file ids aren't supported on this platform")
+	}
+
+	tests := []struct {
+		stream string
+		want   bool
+	}{
+		{fmt.Sprintf("%d:%d", dev, ino), true},
+		{fmt.Sprintf("%d:%d", dev, ino+1), false},
+		{fmt.Sprintf("%d", dev), false},
+		{"", false},
+		{"a:b", false},
+	}
+
+	for _, tt := range tests {
+		if got := isJournalStream(tt.stream, f); got != tt.want {
+			t.Errorf("isJournalStream(%q) = %v, want %v", tt.stream, got, tt.want)
+		}
+	}
+}
+
+func TestWriteJournalField(t *testing.T) {
+	var b strings.Builder
+	writeJournalField(&b, journalFieldName("local"), "notes")
+	writeJournalField(&b, "MESSAGE", "a\nb")
+
+	want := "LOCAL=notes\nMESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if b.String() != want {
+		t.Errorf("journal fields = %q, want %q", b.String(), want)
+	}
+	if got := journalFieldName("_remote-dir"); got != "REMOTE_DIR" {
+		t.Errorf("journalFieldName() = %q, want %q", got, "REMOTE_DIR")
+	}
+}
+
+func TestCheckDeletions(t *testing.T) {
+	changes := []string{"*deleting   a.txt", "*deleting   b.txt", ">f+++++++++ c.txt", "*deleting   old/"}
+	tests := []struct {
+		max     int
+		wantErr bool
+	}{
+		{0, false},
+		{3, false},
+		{2, true},
+	}
+
+	for _, tt := range tests {
+		err := checkDeletions(&Config{MaxDeletions: tt.max}, changes, "pull")
+		if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrTooManyDeletions)) {
+			t.Errorf("checkDeletions() with max %d = %v, wantErr %v", tt.max, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var received []syncEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e syncEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("webhook got invalid json: %v", err)
+		}
+		received = append(received, e)
+	}))
+	defer server.Close()
+
+	out := filepath.Join(t.TempDir(), "events")
+	cfg := &Config{Device: "laptop", Notifiers: []Notifier{
+		{Name: "hook", Type: "webhook", URL: server.URL},
+		{Name: "cmd", Type: "command", Command: `echo "$GS_EVENT $GS_LOCAL" >> ` + out, Events: []string{"success", "deletions_blocked"}},
+	}}
+
+	report := &syncReport{Command: "pull", Local: "notes"}
+	notifyResult(cfg, report, nil)
+	notifyResult(cfg, report, fmt.Errorf("pull aborted: %w", ErrLocalChanged))
+	notifyResult(cfg, report, fmt.Errorf("pull aborted: %w", ErrTooManyDeletions))
+	notifyResult(cfg, report, errors.New("rsync failed: exit status 12\nconnection unexpectedly closed"))
+	notifyResult(cfg, &syncReport{Command: "push", Local: "notes", DryRun: true}, nil)
+
+	var events []string
+	for _, e := range received {
+		events = append(events, e.Event)
+		if e.Device != "laptop" || e.Local != "notes" || strings.Contains(e.Message, "\n") {
+			t.Errorf("webhook got %+v", e)
+		}
+	}
+	if want := []string{"conflict", "deletions_blocked", "failure"}; !slices.Equal(events, want) {
+		t.Errorf("webhook events = %v, want %v", events, want)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "success notes\ndeletions_blocked notes\n"; string(data) != want {
+		t.Errorf("command output = %q, want %q", data, want)
+	}
+
+	received = nil
+	notifyFailure(cfg, "push", "notes", errors.New("timeout waiting for an unmetered connection"))
+	if len(received) != 1 || received[0].Command != "push" || !strings.HasPrefix(received[0].Message, "push of 'notes' failed") {
+		t.Errorf("notifyFailure() sent %+v", received)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	cfg := &Config{
+		Server:     "user@host",
+		RemotePath: "/srv/sync",
+		Hooks: Hooks{
+			PrePush:  `echo "global $GS_HOOK $GS_LOCAL $GS_REMOTE" >> ` + out,
+			PostPull: `echo "$GS_CHANGE_COUNT $(cat "$GS_CHANGES_FILE" | tr '\n' ,)" >> ` + out,
+		},
+	}
+	local := &Local{Name: "notes", Path: dir, Hooks: Hooks{
+		PrePush: `echo "local $PWD" >> ` + out,
+		PrePull: "test ! -e .lock",
+	}}
+
+	push := &syncReport{Command: "push"}
+	if err := runHooks(cfg, local, "pre_push", push); err != nil {
+		t.Fatalf("pre_push failed: %v", err)
+	}
+	pull := &syncReport{Command: "pull", Changes: []string{"new       a.txt", "deleted   b.txt"}}
+	if err := runHooks(cfg, local, "post_pull", pull); err != nil {
+		t.Fatalf("post_pull failed: %v", err)
+	}
+	if err := runHooks(cfg, local, "pre_pull", pull); err != nil {
+		t.Fatalf("pre_pull failed without a lock file: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ".lock"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runHooks(cfg, local, "pre_pull", pull); err == nil {
+		t.Error("pre_pull expected to fail with a lock file")
+	}
+	if err := runHooks(cfg, local, "pre_pull", &syncReport{Command: "pull", DryRun: true}); err != nil {
+		t.Errorf("hooks expected to be skipped for dry runs, got %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "global pre_push notes user@host:/srv/sync/notes\nlocal " + dir + "\n2 new       a.txt,deleted   b.txt,\n"
+	if string(data) != want {
+		t.Errorf("hook output = %q, want %q", data, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	cfg := &Config{Locals: []Local{{Name: "notes"}, {Name: `odd "name"`}}}
+	start := time.Unix(1700000000, 0)
+	recordHistory(&syncReport{Command: "push", Local: "notes", Started: start, Stats: transferStats{BytesSent: 100, BytesReceived: 10}}, nil)
+	recordHistory(&syncReport{Command: "pull", Local: "notes", Started: start.Add(time.Hour), Stats: transferStats{BytesReceived: 5}}, errors.New("rsync failed"))
+	recordHistory(&syncReport{Command: "pull", Local: "gone", Started: start}, nil)
+	// recorded before totals were kept
+	appendHistory(historyEntry{Time: start, Config: configPath(), Local: `odd "name"`, BytesSent: 7, Status: "ok"})
+
+	recordPending(&cfg.Locals[0], 0, -1) // the other direction isn't known yet
+	if _, ok := loadPending(&cfg.Locals[0]); ok {
+		t.Error("recordPending() stored a partial count")
+	}
+	recordPending(&cfg.Locals[0], 2, 3)
+	recordPending(&cfg.Locals[0], 0, -1)
+
+	metrics, err := collectMetrics(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := writeMetrics(&b, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "gs_pending_checked") {
+			samples = append(samples, line)
+		}
+	}
+	want := []string{
+		`gs_last_success_timestamp_seconds{local="notes"} 1700000000.000`,
+		`gs_last_success_timestamp_seconds{local="odd \"name\""} 1700000000.000`,
+		`gs_last_failure_timestamp_seconds{local="notes"} 1700003600.000`,
+		`gs_last_failure_timestamp_seconds{local="odd \"name\""} 0`,
+		`gs_transferred_bytes_total{local="notes",direction="sent"} 100`,
+		`gs_transferred_bytes_total{local="notes",direction="received"} 15`,
+		`gs_transferred_bytes_total{local="odd \"name\"",direction="sent"} 7`,
+		`gs_transferred_bytes_total{local="odd \"name\"",direction="received"} 0`,
+		`gs_pending_changes{local="notes",direction="push"} 0`,
+		`gs_pending_changes{local="notes",direction="pull"} 3`,
+	}
+	if !slices.Equal(samples, want) {
+		t.Errorf("metrics samples =\n%s\nwant\n%s", strings.Join(samples, "\n"), strings.Join(want, "\n"))
+	}
+
+	// once the totals exist the history isn't read anymore
+	if err := os.Remove(historyPath()); err != nil {
+		t.Fatal(err)
+	}
+	again, err := collectMetrics(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b2 strings.Builder
+	writeMetrics(&b2, again)
+	if b2.String() != b.String() {
+		t.Errorf("metrics without history =\n%s\nwant\n%s", b2.String(), b.String())
+	}
+}
+
+func TestParseGitStatus(t *testing.T) {
+	output := " M notes/a.txt\x00R  notes/new.txt\x00notes/old.txt\x00?? notes/drafts/\x00A  notes/b.txt\x00"
+	changed, untracked := parseGitStatus(output, "notes/")
+	if want := []string{"a.txt", "new.txt", "b.txt"}; !slices.Equal(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+	if want := []string{"drafts/"}; !slices.Equal(untracked, want) {
+		t.Errorf("untracked = %v, want %v", untracked, want)
+	}
+}
+
+func TestEscapePattern(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"build/", "build/"},
+		{"a*b.txt", `a\*b.txt`},
+		{"[x]?", `\[x]\?`},
+	}
+	for _, tt := range tests {
+		if got := escapePattern(tt.path); got != tt.want {
+			t.Errorf("escapePattern(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGitExcludes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	run := func(args ...string) {
+		if _, err := git(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name, content string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q")
+	write(".gitignore", "build/\n*.log\n")
+	write("a.txt", "a")
+	write("build/out", "x")
+	write("debug.log", "x")
+	run("add", ".")
+	run("commit", "-q", "-m", "init")
+
+	local := &Local{Name: "repo", Path: dir, Git: true, SyncGitDir: true}
+	got := gitExcludes(local, []string{".git/", "*.tmp"})
+	if want := []string{"*.tmp", "/build/", "/debug.log"}; !slices.Equal(got, want) {
+		t.Errorf("clean repo excludes = %v, want %v", got, want)
+	}
+	if err := checkGitPush(local); err != nil {
+		t.Errorf("push of a clean repo refused: %v", err)
+	}
+
+	write("a.txt", "changed")
+	local.git = nil
+	got = gitExcludes(local, nil)
+	if want := []string{".git", "/build/", "/debug.log"}; !slices.Equal(got, want) {
+		t.Errorf("dirty repo excludes = %v, want %v", got, want)
+	}
+	if want := []string{"a.txt"}; !slices.Equal(local.git.changed, want) {
+		t.Errorf("changed = %v, want %v", local.git.changed, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ".git", "MERGE_HEAD"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	local.git = nil
+	if err := checkGitPush(local); err == nil || !strings.Contains(err.Error(), "merge") {
+		t.Errorf("push during a merge: got %v, want an error", err)
+	}
+}
+
+func TestLocalMode(t *testing.T) {
+	tests := []struct {
+		mode               string
+		push, pull, delete bool
+	}{
+		{"", true, true, true},
+		{"bidirectional", true, true, true},
+		{"mirror-push", true, false, true},
+		{"mirror-pull", false, true, true},
+		{"append-only", true, true, false},
+	}
+	for _, tt := range tests {
+		l := &Local{Name: "notes", Mode: tt.mode}
+		if got := l.allows("push") == nil; got != tt.push {
+			t.Errorf("mode %q: push allowed = %v, want %v", tt.mode, got, tt.push)
+		}
+		if got := l.allows("pull") == nil; got != tt.pull {
+			t.Errorf("mode %q: pull allowed = %v, want %v", tt.mode, got, tt.pull)
+		}
+		if got := l.deletes(); got != tt.delete {
+			t.Errorf("mode %q: deletes = %v, want %v", tt.mode, got, tt.delete)
+		}
+		push, pull := l.syncedChanges([]string{">f.st...... a.md"}, []string{">f.st...... b.md"})
+		if (push != nil) != tt.push || (pull != nil) != tt.pull {
+			t.Errorf("mode %q: syncedChanges() = %q, %q", tt.mode, push, pull)
+		}
+	}
+}
+
+func TestVerifyFollowedLinks(t *testing.T) {
+	fakeSSH(t)
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	cfg := &Config{Server: "host", Port: "22", RemotePath: t.TempDir()}
+	local := &Local{Name: "notes", Path: t.TempDir(), Symlinks: symlinksFollow}
+	remote := filepath.Join(cfg.RemotePath, "notes")
+
+	for _, root := range []string{local.Path, remote} {
+		os.MkdirAll(filepath.Join(root, "dir"), 0755)
+		os.WriteFile(filepath.Join(root, "real.md"), []byte("real"), 0644)
+		os.WriteFile(filepath.Join(root, "dir", "x.md"), []byte("x"), 0644)
+	}
+	for link, target := range map[string]string{"link.md": "real.md", "linkdir": "dir", "loop": ".", "dangling": "nowhere"} {
+		if err := os.Symlink(target, filepath.Join(local.Path, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rsync's --copy-links left copies on the remote
+	os.MkdirAll(filepath.Join(remote, "linkdir"), 0755)
+	os.WriteFile(filepath.Join(remote, "link.md"), []byte("real"), 0644)
+	os.WriteFile(filepath.Join(remote, "linkdir", "x.md"), []byte("x"), 0644)
+
+	states, err := snapshotTree(local.Path, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := slices.Sorted(maps.Keys(states))
+	if want := []string{"dir/x.md", "link.md", "linkdir/x.md", "real.md"}; !slices.Equal(got, want) {
+		t.Errorf("snapshotTree() following links = %v, want %v", got, want)
+	}
+
+	mismatches, err := verifyTransfer(cfg, local, nil)
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("verifyTransfer() = %v, %v, want no mismatches", mismatches, err)
+	}
+	localHashes, err := hashTree(local.Path, nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteHashes, err := hashRemote(cfg, "notes", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatches := compareHashes(localHashes, remoteHashes); len(mismatches) != 0 {
+		t.Errorf("compareHashes() following links = %v, want none", mismatches)
+	}
+}
+
+func TestUnsafeLinks(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"sub", "cache"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"inside":       "sub/file",
+		"sub/up":       "../inside",
+		"sub/escape":   "../../elsewhere",
+		"absolute":     "/etc/hosts",
+		"cache/ignore": "/tmp",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := unsafeLinks(root, []string{"cache/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"absolute -> /etc/hosts", "sub/escape -> ../../elsewhere"}
+	if !slices.Equal(got, want) {
+		t.Errorf("unsafeLinks() = %v, want %v", got, want)
+	}
+}
+
+func TestFileTransfers(t *testing.T) {
+	changes := []string{
+		">f+++++++++ videos/big.mp4",
+		"cd+++++++++ videos/",
+		">f.st...... notes/a.md",
+		"*deleting   old.iso",
+	}
+	want := []string{">f+++++++++ videos/big.mp4", ">f.st...... notes/a.md"}
+	if got := fileTransfers(changes); !slices.Equal(got, want) {
+		t.Errorf("fileTransfers() = %v, want %v", got, want)
+	}
+}
+
+func TestExcludesForLocalPartialDir(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", partialDir + "/a.txt"} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &Config{Excludes: []string{"*.tmp"}}
+	local := &Local{Name: "notes", Path: root}
+	b, err := snapshotLocal(root, "", cfg.ExcludesForLocal(local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := slices.Sorted(maps.Keys(b)); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("snapshot = %v, want only a.txt", got)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args      []string
+		want      []string
+		wantForce bool
+	}{
+		{[]string{"a.txt", "--force", "b.txt"}, []string{"a.txt", "b.txt"}, true},
+		{[]string{"--force", "--", "-notes.md", "--force"}, []string{"-notes.md", "--force"}, true},
+		{[]string{"a.txt", "--", "-b.txt"}, []string{"a.txt", "-b.txt"}, false},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("push", flag.ContinueOnError)
+		force := fs.Bool("force", false, "")
+		if got := parseFlags(fs, tt.args); !slices.Equal(got, tt.want) || *force != tt.wantForce {
+			t.Errorf("parseFlags(%q) = %q, force %v, want %q, force %v", tt.args, got, *force, tt.want, tt.wantForce)
+		}
+	}
+}
+
+func TestWithoutDeleted(t *testing.T) {
+	changes := []string{
+		"cd+++++++++ old/",
+		">f+++++++++ old/a.md",
+		"cd+++++++++ docs/",
+		">f+++++++++ docs/gone.md",
+		">f+++++++++ docs/new.md",
+		">f.st...... todo.md",
+		">f+++++++++ gone.md",
+	}
+	deleted := map[string]bool{"old/a.md": true, "docs/gone.md": true, "gone.md": true}
+	want := []string{"cd+++++++++ docs/", ">f+++++++++ docs/new.md", ">f.st...... todo.md"}
+	if got := withoutDeleted(changes, deleted); !slices.Equal(got, want) {
+		t.Errorf("withoutDeleted() = %q, want %q", got, want)
+	}
+
+	remote := fileState{Size: 3, ModTime: 1700000000 * int64(time.Second)}
+	if !sameState(remote, fileState{Size: 3, ModTime: remote.ModTime + 250}) {
+		t.Error("sameState() expected states within the same second to match")
+	}
+	if sameState(remote, fileState{Size: 4, ModTime: remote.ModTime}) {
+		t.Error("sameState() expected different sizes not to match")
+	}
+}
+
+func TestFindPushConflictsAppendOnly(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	local := &Local{Name: "notes", Path: t.TempDir(), Mode: modeAppendOnly}
+	changes := []string{
+		"cd+++++++++ docs/",
+		">f+++++++++ docs/new.md",
+		">f.st...... todo.md",
+	}
+	got, err := findPushConflicts(&Config{}, local, changes)
+	if err != nil {
+		t.Fatalf("findPushConflicts() unexpected error: %v", err)
+	}
+	if want := []string{">f.st...... todo.md"}; !slices.Equal(got, want) {
+		t.Errorf("findPushConflicts() = %q, want %q", got, want)
+	}
+}
+
+func TestCheckPushPaths(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.md"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// encrypted locals aren't looked up on the remote, so no server is needed
+	local := &Local{Name: "notes", Path: root, Encrypt: true}
+	cfg := &Config{Locals: []Local{*local}}
+
+	if err := checkPushPaths(cfg, local, []string{"file.md"}); err != nil {
+		t.Errorf("existing path rejected: %v", err)
+	}
+	if err := checkPushPaths(cfg, local, []string{"gone.md"}); err == nil {
+		t.Error("unknown missing path expected to be rejected")
+	}
+
+	b := baseline{"gone.md": {Size: 1}, "old/a.md": {Size: 1}}
+	if err := saveBaseline(local, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPushPaths(cfg, local, []string{"gone.md", "old", "file.md"}); err != nil {
+		t.Errorf("paths deleted since the last sync rejected: %v", err)
+	}
+	if err := checkPushPaths(cfg, local, []string{"ol"}); err == nil {
+		t.Error("prefix of a known directory expected to be rejected")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// every push and pull that isn't a dry run is appended to a history file as
+// one json object per line, which 'gs log' reads back
+
+type historyEntry struct {
+	Time          time.Time `json:"time"`
+	Config        string    `json:"config"`
+	Command       string    `json:"command"`
+	Local         string    `json:"local"`
+	Paths         []string  `json:"paths,omitempty"`
+	Files         int       `json:"files"`
+	Deleted       int       `json:"deleted"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Duration      float64   `json:"duration"` // in seconds
+	Status        string    `json:"status"`   // "ok" or "failed"
+	Error         string    `json:"error,omitempty"`
+	Changes       []string  `json:"changes,omitempty"`
+}
+
+func historyPath() string {
+	return filepath.Join(stateDir(), "history.jsonl")
+}
+
+// recordHistory appends the outcome of a push or pull to the history
+func recordHistory(report *syncReport, runErr error) {
+	if report.DryRun {
+		return
+	}
+
+	entry := historyEntry{
+		Time:          report.Started,
+		Config:        configPath(),
+		Command:       report.Command,
+		Local:         report.Local,
+		Paths:         report.Paths,
+		Files:         report.Stats.Files,
+		Deleted:       report.Stats.Deleted,
+		BytesSent:     report.Stats.BytesSent,
+		BytesReceived: report.Stats.BytesReceived,
+		Duration:      time.Since(report.Started).Round(time.Millisecond).Seconds(),
+		Status:        "ok",
+		Changes:       report.Changes,
+	}
+	if runErr != nil {
+		entry.Status = "failed"
+		entry.Error = runErr.Error()
+	}
+
+	// the totals come first, so the history they're built from the first
+	// time doesn't have this entry yet
+	if err := recordTotals(entry); err != nil {
+		logWarn("failed to update totals: %s", err)
+	}
+	if err := appendHistory(entry); err != nil {
+		logWarn("failed to record history: %s", err)
+	}
+}
+
+func appendHistory(entry historyEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func loadHistory() ([]historyEntry, error) {
+	f, err := os.Open(historyPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20) // entries list every change of a run
+	for scanner.Scan() {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // skip lines cut off by a crash
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// renameHistory moves the entries of a renamed local of this config to its
+// new name, so 'gs log' shows them together with later ones
+func renameHistory(oldName, newName string) error {
+	path := historyPath()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	config := configPath()
+	var out bytes.Buffer
+	changed := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry historyEntry
+		if json.Unmarshal(line, &entry) == nil && entry.Local == oldName && entry.Config == config {
+			entry.Local = newName
+			if line, err = json.Marshal(entry); err != nil {
+				return err
+			}
+			line = append(line, '\n')
+			changed = true
+		}
+		out.Write(line)
+	}
+	if !changed {
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+type logFilter struct {
+	Local string
+	Since time.Time
+	File  string // relative to the local's root
+}
+
+func (f logFilter) match(entry historyEntry) bool {
+	if f.Local != "" && entry.Local != f.Local {
+		return false
+	}
+	if entry.Time.Before(f.Since) {
+		return false
+	}
+
+	return f.File == "" || len(f.changesOf(entry)) > 0
+}
+
+// changesOf returns the changes of the entry touching the filter's file, or
+// anything below it if it's a directory
+func (f logFilter) changesOf(entry historyEntry) []string {
+	var changes []string
+	for _, c := range entry.Changes {
+		_, p, _ := strings.Cut(c, " ")
+		p = strings.TrimSuffix(strings.TrimLeft(p, " "), "/")
+		if p == f.File || strings.HasPrefix(p, f.File+"/") {
+			changes = append(changes, c)
+		}
+	}
+
+	return changes
+}
+
+// parseSince accepts durations like '7d', '2w' or '12h' and dates like
+// '2024-05-01'
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+
+	days := map[byte]int{'d': 1, 'w': 7}
+	if n := len(s); n > 1 && days[s[n-1]] > 0 {
+		count, err := strconv.Atoi(s[:n-1])
+		if err == nil && count >= 0 {
+			return now.AddDate(0, 0, -count*days[s[n-1]]), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time '%s' (expected e.g. '7d', '12h' or '2024-05-01')", s)
+	}
+
+	return now.Add(-d), nil
+}
+
+func (e historyEntry) summary() string {
+	parts := []string{fmt.Sprintf("%d file(s)", e.Files)}
+	if e.Deleted > 0 {
+		parts = append(parts, fmt.Sprintf("%d deleted", e.Deleted))
+	}
+	parts = append(parts, fmt.Sprintf("%s sent", formatSize(e.BytesSent)), fmt.Sprintf("%s received", formatSize(e.BytesReceived)))
+	parts = append(parts, fmt.Sprintf("%.1fs", e.Duration))
+
+	return strings.Join(parts, ", ")
+}
+
+func cmdLog(filter logFilter) error {
+	entries, err := loadHistory()
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+
+	config := configPath()
+	found := false
+	for _, entry := range entries {
+		if entry.Config != config || !filter.match(entry) {
+			continue
+		}
+		found = true
+
+		status := "ok"
+		if entry.Status != "ok" {
+			reason, _, _ := strings.Cut(entry.Error, "\n")
+			status = "failed: " + reason
+		}
+		fmt.Printf("%s  %-4s  %s%s  %s (%s)\n", entry.Time.Local().Format("2006-01-02 15:04"),
+			entry.Command, entry.Local, describePaths(entry.Paths), entry.summary(), status)
+		if filter.File != "" {
+			for _, c := range filter.changesOf(entry) {
+				fmt.Printf("  %s\n", c)
+			}
+		}
+	}
+
+	if !found {
+		logSuccess("no matching syncs in the history")
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// hooks are shell commands run around pushes and pulls, in the local's
+// directory. pre hooks run before gs looks at any files, so e.g. a database
+// flushed by pre_push is part of the push, and a failing one aborts it. post
+// hooks run after a successful transfer and get the list of changes
+
+type Hooks struct {
+	PrePush  string `toml:"pre_push,omitempty"`
+	PostPush string `toml:"post_push,omitempty"`
+	PrePull  string `toml:"pre_pull,omitempty"`
+	PostPull string `toml:"post_pull,omitempty"`
+}
+
+func (h *Hooks) command(hook string) string {
+	switch hook {
+	case "pre_push":
+		return h.PrePush
+	case "post_push":
+		return h.PostPush
+	case "pre_pull":
+		return h.PrePull
+	case "post_pull":
+		return h.PostPull
+	}
+
+	return ""
+}
+
+// runHooks runs the global hook and then the local's own, stopping at the
+// first one that fails
+func runHooks(cfg *Config, local *Local, hook string, report *syncReport) error {
+	if report.DryRun {
+		return nil
+	}
+
+	for _, command := range []string{cfg.Hooks.command(hook), local.Hooks.command(hook)} {
+		if command == "" {
+			continue
+		}
+		logProgress("running %s hook...", hook)
+		if err := runHook(cfg, local, hook, command, report); err != nil {
+			return fmt.Errorf("%s hook failed: %w", hook, err)
+		}
+	}
+
+	return nil
+}
+
+func runHook(cfg *Config, local *Local, hook, command string, report *syncReport) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = local.Path
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GS_HOOK="+hook,
+		"GS_COMMAND="+report.Command,
+		"GS_LOCAL="+local.Name,
+		"GS_LOCAL_PATH="+local.Path,
+		"GS_REMOTE="+cfg.RemoteForLocal(local),
+		"GS_PATHS="+strings.Join(report.Paths, "\n"),
+	)
+
+	// the change list can be too long for an environment variable
+	if strings.HasPrefix(hook, "post_") {
+		f, err := os.CreateTemp("", "gs-changes-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		for _, c := range report.Changes {
+			fmt.Fprintln(f, c)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env,
+			"GS_CHANGES_FILE="+f.Name(),
+			fmt.Sprintf("GS_CHANGE_COUNT=%d", len(report.Changes)),
+		)
+	}
+
+	return cmd.Run()
+}
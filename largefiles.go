@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// large files stall every sync they're part of. locals can skip files over
+// 'max_file_size', 'gs status' warns about pending changes over
+// 'warn_file_size', and interrupted transfers keep what they got so far in
+// partialDir, so the next push or pull continues instead of starting over
+
+// partialDir is relative, so rsync creates it inside the destination
+// directory of each interrupted file; it moves finished files out of it and
+// removes it once it's empty
+const partialDir = ".gs-partial"
+
+// largeChanges returns the pending transfers in the directions the local's
+// mode allows, limited by the size options in opts; deletions and
+// directories are left out since size limits don't apply to them
+func largeChanges(cfg *Config, local *Local, opts rsyncOptions) (push, pull []string, err error) {
+	root, err := syncRoot(cfg, local)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := cfg.RemoteForLocal(local)
+
+	if local.pushes() {
+		changes, err := planTransfer(root, remote, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		push = fileTransfers(changes)
+	}
+	if local.pulls() {
+		changes, err := planTransfer(remote, root, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		pull = fileTransfers(changes)
+	}
+
+	return push, pull, nil
+}
+
+func fileTransfers(changes []string) []string {
+	var files []string
+	for _, c := range changes {
+		if !isDeletion(c) && !strings.HasSuffix(changePath(c), "/") {
+			files = append(files, c)
+		}
+	}
+
+	return files
+}
+
+// warnLargeFiles lists the files skipped for being over 'max_file_size' and
+// the pending changes over 'warn_file_size'
+func warnLargeFiles(cfg *Config, local *Local, syncOpts syncOptions) error {
+	opts := cfg.rsyncOptions(local)
+	opts.Paths = syncOpts.Paths
+	opts.Checksum = opts.Checksum || syncOpts.Checksum
+	maxSize := opts.MaxSize
+
+	if maxSize > 0 {
+		opts.MaxSize, opts.MinSize = 0, maxSize+1
+		push, pull, err := largeChanges(cfg, local, opts)
+		if err != nil {
+			return err
+		}
+		listLargeFiles(fmt.Sprintf("files over max_file_size (%s) are skipped:", formatSize(maxSize)), push, pull)
+	}
+
+	if cfg.WarnFileSize == "" {
+		return nil
+	}
+	warnSize, _ := parseSize(cfg.WarnFileSize) // validated on load
+	if maxSize > 0 && warnSize >= maxSize {
+		return nil
+	}
+	opts.MaxSize, opts.MinSize = maxSize, warnSize+1
+	push, pull, err := largeChanges(cfg, local, opts)
+	if err != nil {
+		return err
+	}
+	listLargeFiles(fmt.Sprintf("pending changes over %s:", formatSize(warnSize)), push, pull)
+
+	return nil
+}
+
+func listLargeFiles(message string, push, pull []string) {
+	if len(push) == 0 && len(pull) == 0 {
+		return
+	}
+
+	logWarn("%s", message)
+	for _, c := range push {
+		fmt.Printf("  %s (push)\n", changePath(c))
+	}
+	for _, c := range pull {
+		fmt.Printf("  %s (pull)\n", changePath(c))
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// messages go through slog: the console handler prints them in the usual
+// '[~]', '[+]' and '[!]' style, while the log file and the systemd journal
+// also get their level and the fields of the running operation (local,
+// remote, operation). listings and other output commands are asked for are
+// still printed directly
+
+// levelSuccess is info that finishes a step, printed with '[+]'
+const levelSuccess = slog.LevelInfo + 1
+
+const (
+	defaultLogMaxSize = 10 << 20
+	logBackups        = 3
+	journalSocket     = "/run/systemd/journal/socket"
+)
+
+// set from the global flags
+var logOptions struct {
+	Level   string
+	Verbose bool
+	Quiet   bool
+	File    string
+}
+
+var (
+	logger       = slog.New(&consoleHandler{level: slog.LevelInfo})
+	consoleLevel = slog.LevelInfo
+)
+
+func logAt(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if logger.Enabled(ctx, level) {
+		logger.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func logDebug(format string, args ...any)    { logAt(slog.LevelDebug, format, args...) }
+func logProgress(format string, args ...any) { logAt(slog.LevelInfo, format, args...) }
+func logSuccess(format string, args ...any)  { logAt(levelSuccess, format, args...) }
+func logWarn(format string, args ...any)     { logAt(slog.LevelWarn, format, args...) }
+func logError(format string, args ...any)    { logAt(slog.LevelError, format, args...) }
+
+// logScope adds fields to everything logged until the returned function is
+// called, e.g. 'defer logScope("operation", "pull", "local", name)()'
+func logScope(args ...any) func() {
+	prev := logger
+	logger = logger.With(args...)
+
+	return func() { logger = prev }
+}
+
+// consoleEnabled reports whether the console shows messages of the level,
+// used to silence rsync's streamed output with '-q'
+func consoleEnabled(level slog.Level) bool {
+	return level >= consoleLevel
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level '%s' (expected 'debug', 'info', 'warn' or 'error')", s)
+	}
+
+	return level, nil
+}
+
+// setupLogging configures the logger from the global flags and the config,
+// which may not exist yet (e.g. for 'gs init')
+func setupLogging() error {
+	if logOptions.Verbose && logOptions.Quiet {
+		return fmt.Errorf("-v and -q are mutually exclusive")
+	}
+	switch {
+	case logOptions.Verbose:
+		consoleLevel = slog.LevelDebug
+	case logOptions.Quiet:
+		consoleLevel = slog.LevelWarn
+	}
+	if logOptions.Level != "" {
+		level, err := parseLevel(logOptions.Level)
+		if err != nil {
+			return err
+		}
+		consoleLevel = level
+	}
+
+	var handlers []slog.Handler
+	if journal := openJournal(); journal != nil {
+		// stdout ends up in the journal as well, the messages are sent once
+		// with their priority and fields instead
+		handlers = append(handlers, &journalHandler{conn: journal, level: consoleLevel})
+	} else {
+		handlers = append(handlers, &consoleHandler{level: consoleLevel})
+	}
+
+	path, maxSize := logOptions.File, int64(defaultLogMaxSize)
+	if cfg, err := loadConfig(); err == nil {
+		if path == "" {
+			path = cfg.LogFile
+		}
+		if size, err := parseSize(cfg.LogMaxSize); err == nil && size > 0 {
+			maxSize = size
+		}
+	}
+	if path != "" {
+		f, err := openRotatingFile(expandPath(path), maxSize)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		// the file keeps a trail of unattended runs even with '-q'
+		handlers = append(handlers, slog.NewTextHandler(f, &slog.HandlerOptions{
+			Level:       min(consoleLevel, slog.LevelInfo),
+			ReplaceAttr: replaceLevel,
+		}))
+	}
+
+	logger = slog.New(multiHandler(handlers))
+
+	return nil
+}
+
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == levelSuccess {
+		a.Value = slog.StringValue("INFO")
+	}
+
+	return a
+}
+
+type consoleHandler struct {
+	level slog.Level
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	prefix := "[~]"
+	switch {
+	case r.Level >= slog.LevelWarn:
+		prefix = "[!]"
+	case r.Level == levelSuccess:
+		prefix = "[+]"
+	}
+	// os.Stdout is looked up on every message, '--json' redirects it
+	_, err := fmt.Fprintf(os.Stdout, "%s %s\n", prefix, r.Message)
+
+	return err
+}
+
+// the fields are only for the log file and the journal
+func (h *consoleHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *consoleHandler) WithGroup(string) slog.Handler      { return h }
+
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+
+	return handlers
+}
+
+// rotatingFile appends to a log file, moving it to '<path>.1' (and older
+// ones further up to '<path>.3') once it grows past maxSize
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	for i := logBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+// openJournal connects to journald if stdout or stderr is already connected
+// to it, which systemd announces with $JOURNAL_STREAM
+func openJournal() net.Conn {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if !isJournalStream(stream, os.Stdout) && !isJournalStream(stream, os.Stderr) {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil
+	}
+
+	return conn
+}
+
+// isJournalStream reports whether f is the stream $JOURNAL_STREAM names as
+// 'device:inode'; the variable is inherited by children whose output goes
+// elsewhere, e.g. a shell started from a service
+func isJournalStream(stream string, f *os.File) bool {
+	devStr, inoStr, found := strings.Cut(stream, ":")
+	if !found {
+		return false
+	}
+	dev, err := strconv.ParseUint(devStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	ino, err := strconv.ParseUint(inoStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	fdev, fino, ok := fileID(f)
+
+	return ok && fdev == dev && fino == ino
+}
+
+// journalHandler sends messages with journald's native protocol, so they
+// keep their priority and get fields like LOCAL= and OPERATION=
+type journalHandler struct {
+	conn  net.Conn
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "gs")
+	for _, a := range h.attrs {
+		writeJournalField(&b, journalFieldName(a.Key), a.Value.String())
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeJournalField(&b, journalFieldName(a.Key), a.Value.String())
+		return true
+	})
+	_, err := h.conn.Write([]byte(b.String()))
+
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{conn: h.conn, level: h.level, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *journalHandler) WithGroup(string) slog.Handler { return h }
+
+// syslog priorities, see sd-daemon(3)
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= levelSuccess:
+		return 5
+	case level >= slog.LevelInfo:
+		return 6
+	}
+
+	return 7
+}
+
+// journalFieldName turns a key into a valid field name, e.g. 'local' into 'LOCAL'
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+
+	// leading underscores are reserved for fields set by journald
+	return strings.TrimLeft(name, "_")
+}
+
+// writeJournalField writes 'KEY=value\n', or the length-prefixed form for
+// values spanning multiple lines
+func writeJournalField(b *strings.Builder, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+
+	b.WriteString(key + "\n")
+	size := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		b.WriteByte(byte(size >> (8 * i)))
+	}
+	b.WriteString(value + "\n")
+}
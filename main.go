@@ -1,87 +1,585 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 const usage = `usage:
+	gs [global options] <command> [arguments]
+
 	gs init <user@host:port:/path>  initialize config with remote server
-	gs track                        add current directory to sync list
-	gs untrack                      remove current directory from sync list
-	gs push [options]               sync local to server
-	gs pull                         sync server to local
-	gs status                       show pending changes (dry-run)
+	gs track [path] [options]       add directory (default: current) to sync list
+	gs untrack [path] [options]     remove directory (default: current) from sync list
+	gs rename <old> <new>           rename local and move its remote directory
+	gs relocate <name> <new-path>   point local at the new location of its directory
+	gs push [options] [path...]     sync local (or only the given paths in it) to server
+	gs pull [options] [path...]     sync server to local (or only the given paths in it)
+	gs status [options]             show pending changes (dry-run)
+	gs diff [options] [path]        show differences between local and remote versions
+	gs verify                       hash all files on both sides and report mismatches
+	gs log [options]                show past pushes and pulls
+	gs metrics [options]            print or serve prometheus metrics
 	gs auto [options]               wait for server, then pull all
+	gs remote ls                    list directories on the server
+	gs remote prune [options]       archive or delete remote directories no device tracks
+	gs clone <remote-dir> [dest]    track and pull a directory that exists only on the server
+	gs config <command>             view or modify config settings
+	gs exclude add|rm <pattern>...  add or remove exclude patterns
+	gs keygen <path>                create a key file for encrypted locals
+
+global options (also accepted after the command):
+	--config <path>                 use config file at path (or $GS_CONFIG)
+	--profile <name>                use a named config profile (or $GS_PROFILE)
+	-v, --verbose                   also print debug messages
+	-q, --quiet                     only print warnings and errors
+	--log-level <level>             debug, info, warn or error (default: info)
+	--log-file <path>               also log to a file (or 'log_file' in the config)
+
+track options:
+	--name <name>                   name of the local (default: directory name)
+	--remote-subdir <dir>           directory under remote_path (default: name)
+
+untrack options:
+	--purge-remote                  also delete the remote directory (asks for confirmation)
+	--dry-run                       only list what would be deleted
+	--yes                           don't ask for confirmation
+	--force                         purge even if other devices still track the directory
+
+prune options:
+	--archive                       archive all orphans to <remote_path>/.gs/archive
+	--delete                        delete all orphans
+	--dry-run                       only list orphaned directories
+
+rename options:
+	--keep-remote                   keep the remote directory where it is
+	--remote-subdir <dir>           move the remote directory to <dir> (also with <new> = <old>)
+	--force                         move the remote directory even if other devices track it
+
+clone options:
+	--name <name>                   name of the local (default: last element of remote-dir)
 
 push options:
+	--all                           push every local (except 'mirror-pull' ones)
 	--force                         overwrite remote even if it has unpulled changes
+	--dry-run                       only show what would be transferred or deleted
+	--confirm                       show the plan and ask before overwriting or deleting files
+	--checksum                      compare file contents instead of size and modification time
+	--verify                        compare hashes of both sides after the transfer
+	--bwlimit <rate>                limit bandwidth, e.g. '500K' or '2M' (per second)
+	--json                          print a json report to stdout, other output goes to stderr
+
+pull options:
+	--force                         overwrite local changes that haven't been pushed
+	--dry-run                       only show what would be transferred or deleted
+	--confirm                       show the plan and ask before overwriting or deleting files
+	--checksum                      compare file contents instead of size and modification time
+	--verify                        compare hashes of both sides after the transfer
+	--bwlimit <rate>                limit bandwidth, e.g. '500K' or '2M' (per second)
+	--json                          print a json report to stdout, other output goes to stderr
+
+status options:
+	--checksum                      compare file contents instead of size and modification time
+
+diff options:
+	--tool <cmd>                    open both versions in an external tool (e.g. 'meld')
+
+log options:
+	--local <name>                  only show syncs of this local
+	--since <time>                  only show syncs since e.g. '7d', '12h' or '2024-05-01'
+	--file <path>                   only show syncs that changed path (relative to the local)
+
+metrics options:
+	--check                         check pending changes of all locals first
+	--listen <addr>                 serve metrics on http://<addr>/metrics (e.g. ':9469')
 
 auto options:
 	--interval <duration>           poll interval (default: 30s)
 	--timeout <duration>            max wait time, 0 for infinite (default: 15m)
+	--bwlimit <rate>                limit bandwidth, e.g. '500K' or '2M' (per second)
+
+config commands:
+	list                            show all configured keys
+	get <key>                       show value of key (e.g. 'port', 'locals.notes.excludes')
+	set <key> <value>               set key to a toml value (e.g. '["*.bak"]')
+	unset <key>                     reset key to its default
+	edit                            open config in $EDITOR, validated on save
+
+exclude options:
+	--local <name>                  modify excludes of a single local instead of global ones
 `
 
 func main() {
-	if len(os.Args) < 2 {
+	args, err := parseGlobalFlags(os.Args[1:])
+	if err == nil {
+		err = setupLogging()
+	}
+	if err != nil {
+		fmt.Printf("[!] %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
 		fmt.Print(usage)
 		os.Exit(1)
 	}
 
-	var err error
-	switch os.Args[1] {
+	cmd, args := args[0], args[1:]
+	switch cmd {
 	case "init":
-		err = runInit()
+		err = runInit(args)
 	case "track":
-		err = cmdTrack()
+		err = runTrack(args)
 	case "untrack":
-		err = cmdUntrack()
+		err = runUntrack(args)
+	case "rename":
+		err = runRename(args)
+	case "relocate":
+		err = runRelocate(args)
 	case "push":
-		err = runPush()
+		err = runPush(args)
 	case "pull":
-		err = cmdPull()
+		err = runPull(args)
 	case "status":
-		err = cmdStatus()
+		err = runStatus(args)
+	case "diff":
+		err = runDiff(args)
+	case "verify":
+		err = cmdVerify()
+	case "log":
+		err = runLog(args)
+	case "metrics":
+		err = runMetrics(args)
 	case "auto":
-		err = runAuto()
+		err = runAuto(args)
+	case "remote":
+		err = runRemote(args)
+	case "clone":
+		err = runClone(args)
+	case "config":
+		err = runConfig(args)
+	case "exclude":
+		err = runExclude(args)
+	case "keygen":
+		err = runKeygen(args)
 	case "help", "-h", "--help":
 		fmt.Print(usage)
 	default:
-		fmt.Printf("[!] unknown command: %s\n", os.Args[1])
+		logWarn("unknown command: %s", cmd)
 		fmt.Print(usage)
 		os.Exit(1)
 	}
 
 	if err != nil {
-		fmt.Printf("[!] error during command execution: %s\n", err)
+		logError("error during command execution: %s", err)
 		os.Exit(1)
 	}
 }
 
-func runInit() error {
-	if len(os.Args) < 3 {
+// parseGlobalFlags consumes the global options, which may be given before the
+// command name or anywhere after it up to a '--', and returns the rest
+func parseGlobalFlags(args []string) ([]string, error) {
+	var rest []string
+	for len(args) > 0 {
+		if args[0] == "--" {
+			rest = append(rest, args...)
+			break
+		}
+		n, err := parseGlobalFlag(args)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			rest, args = append(rest, args[0]), args[1:]
+			continue
+		}
+		args = args[n:]
+	}
+
+	if configOverride != "" && configProfile != "" {
+		return nil, fmt.Errorf("--config and --profile are mutually exclusive")
+	}
+	if configProfile != "" && !validProfileName(configProfile) {
+		return nil, fmt.Errorf("invalid profile name '%s'", configProfile)
+	}
+	if env := os.Getenv("GS_PROFILE"); env != "" && !validProfileName(env) {
+		return nil, fmt.Errorf("invalid profile name '%s' in $GS_PROFILE", env)
+	}
+
+	return rest, nil
+}
+
+// parseGlobalFlag consumes a global option at the start of args, returning
+// the number of arguments it took (0 if args doesn't start with one)
+func parseGlobalFlag(args []string) (int, error) {
+	switch args[0] {
+	case "-v", "--verbose":
+		logOptions.Verbose = true
+		return 1, nil
+	case "-q", "--quiet":
+		logOptions.Quiet = true
+		return 1, nil
+	}
+
+	if !strings.HasPrefix(args[0], "--") {
+		return 0, nil
+	}
+	name, value, hasValue := strings.Cut(strings.TrimPrefix(args[0], "--"), "=")
+	if name != "config" && name != "profile" && name != "log-level" && name != "log-file" {
+		return 0, nil
+	}
+	n := 1
+	if !hasValue {
+		if len(args) < 2 {
+			return 0, fmt.Errorf("missing value for --%s", name)
+		}
+		value, n = args[1], 2
+	}
+
+	switch name {
+	case "config":
+		configOverride = value
+	case "profile":
+		configProfile = value
+	case "log-level":
+		logOptions.Level = value
+	case "log-file":
+		logOptions.File = value
+	}
+
+	return n, nil
+}
+
+func runInit(args []string) error {
+	if len(args) < 1 {
 		return fmt.Errorf("usage: gs init <user@host:port:/path>")
 	}
 
-	return cmdInit(os.Args[2])
+	return cmdInit(args[0])
+}
+
+// parseFlags parses flags that may appear before, between or after the
+// positional arguments, which are returned in order; everything after a '--'
+// is positional, e.g. paths starting with '-'
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		// fs.Parse consumes the '--' it stops at
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func runTrack(args []string) error {
+	fs := flag.NewFlagSet("track", flag.ExitOnError)
+	name := fs.String("name", "", "name of the local")
+	remoteSubdir := fs.String("remote-subdir", "", "directory under remote_path")
+	positional := parseFlags(fs, args)
+
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: gs track [path] [--name <name>] [--remote-subdir <dir>]")
+	}
+
+	var dir string
+	if len(positional) == 1 {
+		dir = positional[0]
+	}
+
+	return cmdTrack(dir, *name, *remoteSubdir)
+}
+
+func runUntrack(args []string) error {
+	fs := flag.NewFlagSet("untrack", flag.ExitOnError)
+	var opts untrackOptions
+	fs.BoolVar(&opts.PurgeRemote, "purge-remote", false, "also delete the remote directory")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only list what would be deleted")
+	fs.BoolVar(&opts.Yes, "yes", false, "don't ask for confirmation")
+	fs.BoolVar(&opts.Force, "force", false, "purge even if other devices still track the directory")
+	positional := parseFlags(fs, args)
+
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: gs untrack [path] [--purge-remote [--dry-run] [--yes] [--force]]")
+	}
+
+	var dir string
+	if len(positional) == 1 {
+		dir = positional[0]
+	}
+
+	return cmdUntrack(dir, opts)
+}
+
+func runRename(args []string) error {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	keepRemote := fs.Bool("keep-remote", false, "keep the remote directory where it is")
+	force := fs.Bool("force", false, "move the remote directory even if other devices track it")
+	remoteSubdir := fs.String("remote-subdir", "", "move the remote directory to this one")
+	positional := parseFlags(fs, args)
+
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: gs rename <old> <new> [--keep-remote] [--remote-subdir <dir>] [--force]")
+	}
+	if *keepRemote && *remoteSubdir != "" {
+		return fmt.Errorf("--keep-remote can't be combined with --remote-subdir")
+	}
+
+	return cmdRename(positional[0], positional[1], *remoteSubdir, *keepRemote, *force)
+}
+
+func runRelocate(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: gs relocate <name> <new-path>")
+	}
+
+	return cmdRelocate(args[0], args[1])
 }
 
-func runPush() error {
+func runPush(args []string) error {
 	fs := flag.NewFlagSet("push", flag.ExitOnError)
-	force := fs.Bool("force", false, "overwrite remote even if it has unpulled changes")
-	fs.Parse(os.Args[2:])
+	all := fs.Bool("all", false, "push every local")
+	var opts syncOptions
+	fs.BoolVar(&opts.Force, "force", false, "overwrite remote even if it has unpulled changes")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only show what would be transferred")
+	fs.BoolVar(&opts.Confirm, "confirm", false, "ask before overwriting or deleting files")
+	fs.BoolVar(&opts.Checksum, "checksum", false, "compare file contents instead of size and mtime")
+	fs.BoolVar(&opts.Verify, "verify", false, "compare hashes of both sides after the transfer")
+	fs.StringVar(&opts.BwLimit, "bwlimit", "", "bandwidth limit, e.g. '500K' or '2M'")
+	asJSON := fs.Bool("json", false, "print a json report to stdout")
+	paths := parseFlags(fs, args)
+	if err := validBwLimit(opts.BwLimit); err != nil {
+		return err
+	}
+
+	if *all {
+		if len(paths) > 0 || *asJSON {
+			return fmt.Errorf("--all can't be combined with paths or --json")
+		}
+		return cmdPushAll(opts)
+	}
+
+	return withReport(*asJSON, "push", &opts, func() error {
+		return cmdPush(paths, opts)
+	})
+}
+
+func runPull(args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ExitOnError)
+	var opts syncOptions
+	fs.BoolVar(&opts.Force, "force", false, "overwrite local changes that haven't been pushed")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only show what would be transferred")
+	fs.BoolVar(&opts.Confirm, "confirm", false, "ask before overwriting or deleting files")
+	fs.BoolVar(&opts.Checksum, "checksum", false, "compare file contents instead of size and mtime")
+	fs.BoolVar(&opts.Verify, "verify", false, "compare hashes of both sides after the transfer")
+	fs.StringVar(&opts.BwLimit, "bwlimit", "", "bandwidth limit, e.g. '500K' or '2M'")
+	asJSON := fs.Bool("json", false, "print a json report to stdout")
+	paths := parseFlags(fs, args)
+	if err := validBwLimit(opts.BwLimit); err != nil {
+		return err
+	}
+
+	return withReport(*asJSON, "pull", &opts, func() error {
+		return cmdPull(paths, opts)
+	})
+}
+
+// withReport runs a push or pull and prints its report as json if asked to;
+// everything else is written to stderr then, so stdout only holds the report
+func withReport(asJSON bool, command string, opts *syncOptions, run func() error) error {
+	if !asJSON {
+		return run()
+	}
+
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	opts.Report = &syncReport{Command: command, Changes: []string{}}
+
+	err := run()
+	if err != nil {
+		opts.Report.Error = err.Error()
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if encErr := enc.Encode(opts.Report); encErr != nil {
+		return encErr
+	}
+
+	return err
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var opts syncOptions
+	fs.BoolVar(&opts.Checksum, "checksum", false, "compare file contents instead of size and mtime")
+	fs.Parse(args)
+
+	return cmdStatus(opts)
+}
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	tool := fs.String("tool", "", "external diff tool")
+	paths := parseFlags(fs, args)
+
+	return cmdDiff(paths, *tool)
+}
+
+func runLog(args []string) error {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	var filter logFilter
+	fs.StringVar(&filter.Local, "local", "", "only show syncs of this local")
+	since := fs.String("since", "", "only show syncs since e.g. '7d' or '2024-05-01'")
+	fs.StringVar(&filter.File, "file", "", "only show syncs that changed path")
+	fs.Parse(args)
+
+	if *since != "" {
+		var err error
+		if filter.Since, err = parseSince(*since, time.Now()); err != nil {
+			return err
+		}
+	}
+	filter.File = strings.Trim(filepath.ToSlash(filepath.Clean(filter.File)), "/")
+	if filter.File == "." {
+		filter.File = ""
+	}
+
+	return cmdLog(filter)
+}
+
+func runMetrics(args []string) error {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	check := fs.Bool("check", false, "check pending changes of all locals first")
+	listen := fs.String("listen", "", "serve metrics on this address")
+	fs.Parse(args)
 
-	return cmdPush(*force)
+	return cmdMetrics(*listen, *check)
 }
 
-func runAuto() error {
+func runAuto(args []string) error {
 	fs := flag.NewFlagSet("auto", flag.ExitOnError)
-	interval := fs.Duration("interval", 30*time.Second, "poll interval")
-	timeout := fs.Duration("timeout", 15*time.Minute, "max wait time (0 for infinite)")
-	fs.Parse(os.Args[2:])
+	interval := fs.Duration("interval", defaultInterval, "poll interval")
+	timeout := fs.Duration("timeout", defaultTimeout, "max wait time (0 for infinite)")
+	var opts syncOptions
+	fs.StringVar(&opts.BwLimit, "bwlimit", "", "bandwidth limit, e.g. '500K' or '2M'")
+	fs.Parse(args)
+	if err := validBwLimit(opts.BwLimit); err != nil {
+		return err
+	}
+
+	return cmdAuto(*interval, *timeout, opts)
+}
+
+func runRemote(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: gs remote ls|prune")
+	}
+
+	switch args[0] {
+	case "ls":
+		return cmdRemoteLs()
+	case "prune":
+		fs := flag.NewFlagSet("prune", flag.ExitOnError)
+		archive := fs.Bool("archive", false, "archive all orphans")
+		del := fs.Bool("delete", false, "delete all orphans")
+		dryRun := fs.Bool("dry-run", false, "only list orphaned directories")
+		fs.Parse(args[1:])
+
+		action := pruneAsk
+		switch {
+		case *archive && *del:
+			return fmt.Errorf("--archive and --delete are mutually exclusive")
+		case *archive:
+			action = pruneArchive
+		case *del:
+			action = pruneDelete
+		}
+		return cmdRemotePrune(action, *dryRun)
+	default:
+		return fmt.Errorf("unknown remote command: %s", args[0])
+	}
+}
+
+func runClone(args []string) error {
+	fs := flag.NewFlagSet("clone", flag.ExitOnError)
+	name := fs.String("name", "", "name of the local")
+	positional := parseFlags(fs, args)
+
+	if len(positional) < 1 || len(positional) > 2 {
+		return fmt.Errorf("usage: gs clone <remote-dir> [dest] [--name <name>]")
+	}
+
+	var dest string
+	if len(positional) == 2 {
+		dest = positional[1]
+	}
 
-	return cmdAuto(*interval, *timeout)
+	return cmdClone(positional[0], dest, *name)
 }
 
+func runConfig(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: gs config list|get|set|unset|edit")
+	}
+
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "list":
+		return cmdConfigList()
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: gs config get <key>")
+		}
+		return cmdConfigGet(args[0])
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: gs config set <key> <value>")
+		}
+		return cmdConfigSet(args[0], args[1])
+	case "unset":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: gs config unset <key>")
+		}
+		return cmdConfigUnset(args[0])
+	case "edit":
+		return cmdConfigEdit()
+	default:
+		return fmt.Errorf("unknown config command: %s", sub)
+	}
+}
+
+func runExclude(args []string) error {
+	if len(args) < 1 || (args[0] != "add" && args[0] != "rm") {
+		return fmt.Errorf("usage: gs exclude add|rm [--local <name>] <pattern>...")
+	}
+
+	fs := flag.NewFlagSet("exclude", flag.ExitOnError)
+	local := fs.String("local", "", "modify excludes of a single local")
+	fs.Parse(args[1:])
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: gs exclude add|rm [--local <name>] <pattern>...")
+	}
+
+	return cmdExclude(args[0] == "add", fs.Args(), *local)
+}
+
+func runKeygen(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: gs keygen <path>")
+	}
+
+	return cmdKeygen(args[0])
+}
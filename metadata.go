@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// rsync's -a preserves symlinks, permissions, owner and group, which don't
+// always make sense on another machine: absolute links break, uids differ and
+// so does the umask. locals choose what happens to each of them:
+//
+//	symlinks = "preserve" | "follow" | "skip"
+//	perms    = "preserve" | "normalize" (with 'chmod', default "D755,F644")
+//	owner    = false (default) | true
+//
+// owner and group are never preserved unless 'owner' is set, as that needs
+// root on the receiving side and the same uids on every machine
+
+const (
+	symlinksPreserve = "preserve" // transfer links as links (default)
+	symlinksFollow   = "follow"   // transfer the files links point to
+	symlinksSkip     = "skip"     // leave links out
+)
+
+var symlinkPolicies = []string{symlinksPreserve, symlinksFollow, symlinksSkip}
+
+const defaultChmod = "D755,F644"
+
+// a comma separated list of rsync's --chmod items, e.g. "D755,F644" or
+// "Du=rwx,go=rx,Fu=rw,go=r"
+var chmodItem = regexp.MustCompile(`^[DF]?([0-7]{3,4}|[ugoa]*[-+=][rwxXst]*)$`)
+
+func validMetadataPolicy(l *Local) error {
+	if l.Symlinks != "" && !slices.Contains(symlinkPolicies, l.Symlinks) {
+		return fmt.Errorf("invalid symlinks policy '%s' (expected one of %s)", l.Symlinks, strings.Join(symlinkPolicies, ", "))
+	}
+	switch l.Perms {
+	case "", "preserve":
+		if l.Chmod != "" {
+			return fmt.Errorf("'chmod' requires 'perms = \"normalize\"'")
+		}
+	case "normalize":
+		for _, item := range strings.Split(l.chmod(), ",") {
+			if !chmodItem.MatchString(item) {
+				return fmt.Errorf("invalid chmod '%s'", l.Chmod)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid perms policy '%s' (expected 'preserve' or 'normalize')", l.Perms)
+	}
+
+	return nil
+}
+
+// chmod returns the permissions transferred files get, empty to keep them
+func (l *Local) chmod() string {
+	if l.Perms != "normalize" {
+		return ""
+	}
+	if l.Chmod == "" {
+		return defaultChmod
+	}
+
+	return l.Chmod
+}
+
+// followsLinks reports whether transfers replace links with what they point
+// to; encrypted locals transfer their staged copy, which has no links
+func (l *Local) followsLinks() bool {
+	return l.Symlinks == symlinksFollow && !l.Encrypt
+}
+
+// unsafeLinks returns the symlinks under root that are absolute or point
+// outside of it, formatted as 'path -> target'
+func unsafeLinks(root string, excludes []string) ([]string, error) {
+	var links []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == root {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if isExcluded(rel, d.IsDir(), excludes) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if linkEscapes(rel, target) {
+			links = append(links, rel+" -> "+target)
+		}
+
+		return nil
+	})
+
+	return links, err
+}
+
+// linkEscapes reports whether a link at rel (relative to the tree's root)
+// pointing at target leaves the tree
+func linkEscapes(rel, target string) bool {
+	if filepath.IsAbs(target) {
+		return true
+	}
+	resolved := filepath.Join(filepath.Dir(filepath.FromSlash(rel)), target)
+
+	return resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator))
+}
+
+// warnUnsafeLinks lists the links of local that point outside of it, which
+// break on other machines unless they're followed
+func warnUnsafeLinks(cfg *Config, local *Local) {
+	links, err := unsafeLinks(local.Path, cfg.ExcludesForLocal(local))
+	if err != nil {
+		logWarn("failed to check symlinks: %s", err)
+		return
+	}
+	if len(links) == 0 {
+		return
+	}
+
+	logWarn("symlinks pointing outside of '%s':", local.Name)
+	for _, link := range links {
+		fmt.Printf("  %s\n", link)
+	}
+	if local.Symlinks != symlinksFollow {
+		logSuccess("set 'symlinks = \"follow\"' to transfer their targets, or \"skip\" to leave them out")
+	}
+}
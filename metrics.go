@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// metrics are derived from running totals kept next to the sync history and
+// the pending change counts last seen by 'gs status', and exported in
+// prometheus' text format: written to 'metrics_file' after every run for
+// node_exporter's textfile collector, or served by 'gs metrics --listen'
+
+// pendingChanges are the changes waiting to be pushed and pulled
+type pendingChanges struct {
+	Push    int       `json:"push"`
+	Pull    int       `json:"pull"`
+	Checked time.Time `json:"checked"`
+}
+
+func pendingPath(local *Local) string {
+	return filepath.Join(stateDir(), "pending", fmt.Sprintf("%s-%x.json", local.Name, hashString(configPath())))
+}
+
+func loadPending(local *Local) (pendingChanges, bool) {
+	var p pendingChanges
+	data, err := os.ReadFile(pendingPath(local))
+	if err != nil || json.Unmarshal(data, &p) != nil {
+		return p, false
+	}
+
+	return p, true
+}
+
+func savePending(local *Local, p pendingChanges) error {
+	return saveState(pendingPath(local), p)
+}
+
+// saveState replaces the json state file at path atomically
+func saveState(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// recordPending stores the pending change counts, keeping the old count of a
+// direction passed as -1 (nothing is stored while the other one is unknown)
+func recordPending(local *Local, push, pull int) {
+	p, ok := loadPending(local)
+	if !ok && (push < 0 || pull < 0) {
+		return
+	}
+	if push >= 0 {
+		p.Push = push
+	}
+	if pull >= 0 {
+		p.Pull = pull
+	}
+	p.Checked = time.Now()
+
+	if err := savePending(local, p); err != nil {
+		logWarn("failed to save pending changes: %s", err)
+	}
+}
+
+// syncTotals sum up the history of a local, updated with every push and pull
+// so the metrics don't have to read the whole history
+type syncTotals struct {
+	LastSuccess   time.Time `json:"last_success"`
+	LastFailure   time.Time `json:"last_failure"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+func totalsPath(local *Local) string {
+	return filepath.Join(stateDir(), "totals", fmt.Sprintf("%s-%x.json", local.Name, hashString(configPath())))
+}
+
+func (t *syncTotals) add(entry historyEntry) {
+	t.BytesSent += entry.BytesSent
+	t.BytesReceived += entry.BytesReceived
+	if entry.Status == "ok" && entry.Time.After(t.LastSuccess) {
+		t.LastSuccess = entry.Time
+	} else if entry.Status != "ok" && entry.Time.After(t.LastFailure) {
+		t.LastFailure = entry.Time
+	}
+}
+
+// loadTotals returns the totals of the local; the first time they're summed
+// up from the history recorded before totals were kept
+func loadTotals(local *Local) (syncTotals, error) {
+	var t syncTotals
+	data, err := os.ReadFile(totalsPath(local))
+	if err == nil && json.Unmarshal(data, &t) == nil {
+		return t, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return t, err
+	}
+
+	entries, err := loadHistory()
+	if err != nil {
+		return t, err
+	}
+	config := configPath()
+	for _, entry := range entries {
+		if entry.Local == local.Name && entry.Config == config {
+			t.add(entry)
+		}
+	}
+
+	return t, saveState(totalsPath(local), t)
+}
+
+// recordTotals adds a history entry to the totals of its local
+func recordTotals(entry historyEntry) error {
+	local := &Local{Name: entry.Local}
+	t, err := loadTotals(local)
+	if err != nil {
+		return err
+	}
+	t.add(entry)
+
+	return saveState(totalsPath(local), t)
+}
+
+type localMetrics struct {
+	syncTotals
+	Pending      pendingChanges
+	PendingKnown bool
+}
+
+func collectMetrics(cfg *Config) (map[string]*localMetrics, error) {
+	metrics := make(map[string]*localMetrics, len(cfg.Locals))
+	for i := range cfg.Locals {
+		local := &cfg.Locals[i]
+		totals, err := loadTotals(local)
+		if err != nil {
+			return nil, err
+		}
+		m := &localMetrics{syncTotals: totals}
+		m.Pending, m.PendingKnown = loadPending(local)
+		metrics[local.Name] = m
+	}
+
+	return metrics, nil
+}
+
+// writeMetrics writes the metrics in prometheus' text exposition format
+func writeMetrics(w io.Writer, metrics map[string]*localMetrics) error {
+	locals := make([]string, 0, len(metrics))
+	for name := range metrics {
+		locals = append(locals, name)
+	}
+	slices.Sort(locals)
+
+	var b strings.Builder
+	family := func(name, kind, help string, sample func(local string, m *localMetrics)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, local := range locals {
+			sample(local, metrics[local])
+		}
+	}
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return fmt.Sprintf("%.3f", float64(t.UnixMilli())/1000)
+	}
+
+	family("gs_last_success_timestamp_seconds", "gauge", "Time of the last successful push or pull, 0 if there was none.", func(local string, m *localMetrics) {
+		fmt.Fprintf(&b, "gs_last_success_timestamp_seconds{local=%s} %s\n", promLabel(local), timestamp(m.LastSuccess))
+	})
+	family("gs_last_failure_timestamp_seconds", "gauge", "Time of the last failed push or pull, 0 if there was none.", func(local string, m *localMetrics) {
+		fmt.Fprintf(&b, "gs_last_failure_timestamp_seconds{local=%s} %s\n", promLabel(local), timestamp(m.LastFailure))
+	})
+	family("gs_transferred_bytes_total", "counter", "Bytes transferred by pushes and pulls.", func(local string, m *localMetrics) {
+		fmt.Fprintf(&b, "gs_transferred_bytes_total{local=%s,direction=\"sent\"} %d\n", promLabel(local), m.BytesSent)
+		fmt.Fprintf(&b, "gs_transferred_bytes_total{local=%s,direction=\"received\"} %d\n", promLabel(local), m.BytesReceived)
+	})
+	family("gs_pending_changes", "gauge", "Changes waiting to be pushed or pulled, as of the last check.", func(local string, m *localMetrics) {
+		if m.PendingKnown {
+			fmt.Fprintf(&b, "gs_pending_changes{local=%s,direction=\"push\"} %d\n", promLabel(local), m.Pending.Push)
+			fmt.Fprintf(&b, "gs_pending_changes{local=%s,direction=\"pull\"} %d\n", promLabel(local), m.Pending.Pull)
+		}
+	})
+	family("gs_pending_checked_timestamp_seconds", "gauge", "Time the pending changes were last checked.", func(local string, m *localMetrics) {
+		if m.PendingKnown {
+			fmt.Fprintf(&b, "gs_pending_checked_timestamp_seconds{local=%s} %s\n", promLabel(local), timestamp(m.Pending.Checked))
+		}
+	})
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// promLabel quotes a label value
+func promLabel(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// updateMetricsFile rewrites 'metrics_file' if it's configured; the file is
+// replaced atomically so the collector never reads a partial one
+func updateMetricsFile(cfg *Config) {
+	if cfg.MetricsFile == "" {
+		return
+	}
+	if err := writeMetricsFile(cfg, expandPath(cfg.MetricsFile)); err != nil {
+		logWarn("failed to write metrics: %s", err)
+	}
+}
+
+func writeMetricsFile(cfg *Config, path string) error {
+	metrics, err := collectMetrics(cfg)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".gs-*.prom.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := writeMetrics(f, metrics); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// cmdMetrics prints the metrics, or serves them on '/metrics' if listen is set
+func cmdMetrics(listen string, check bool) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if check {
+		for i := range cfg.Locals {
+			local := &cfg.Locals[i]
+			logProgress("checking '%s'...", local.Name)
+			push, pull, err := statusChanges(cfg, local, syncOptions{})
+			if err != nil {
+				logWarn("failed to check '%s': %s", local.Name, err)
+				continue
+			}
+			push, pull = local.syncedChanges(push, pull)
+			recordPending(local, len(push), len(pull))
+		}
+		updateMetricsFile(cfg)
+	}
+
+	if listen == "" {
+		metrics, err := collectMetrics(cfg)
+		if err != nil {
+			return err
+		}
+		return writeMetrics(os.Stdout, metrics)
+	}
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// the config is reloaded so locals tracked since are included
+		cfg, err := loadConfig()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		metrics, err := collectMetrics(cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, metrics)
+	})
+	logProgress("serving metrics on http://%s/metrics", listen)
+
+	return http.ListenAndServe(listen, nil)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// the mode of a local limits which way it's synced, e.g. a shared reference
+// directory set to "mirror-pull" can never be pushed over by accident
+const (
+	modeBidirectional = "bidirectional" // pushed and pulled (default)
+	modeMirrorPush    = "mirror-push"   // only pushed, e.g. a backup
+	modeMirrorPull    = "mirror-pull"   // only pulled, a read-only copy
+	modeAppendOnly    = "append-only"   // pushed and pulled, deletions aren't propagated
+)
+
+var syncModes = []string{modeBidirectional, modeMirrorPush, modeMirrorPull, modeAppendOnly}
+
+func validMode(mode string) error {
+	if mode != "" && !slices.Contains(syncModes, mode) {
+		return fmt.Errorf("invalid mode '%s' (expected one of %s)", mode, strings.Join(syncModes, ", "))
+	}
+
+	return nil
+}
+
+func (l *Local) mode() string {
+	if l.Mode == "" {
+		return modeBidirectional
+	}
+
+	return l.Mode
+}
+
+func (l *Local) pushes() bool {
+	return l.mode() != modeMirrorPull
+}
+
+func (l *Local) pulls() bool {
+	return l.mode() != modeMirrorPush
+}
+
+// deletes reports whether transfers delete files missing on the sending side
+func (l *Local) deletes() bool {
+	return l.mode() != modeAppendOnly
+}
+
+// syncedChanges drops the changes of the directions the mode doesn't sync; a
+// mirror's changes on the other side are overwritten, not synced back
+func (l *Local) syncedChanges(push, pull []string) ([]string, []string) {
+	if !l.pushes() {
+		push = nil
+	}
+	if !l.pulls() {
+		pull = nil
+	}
+
+	return push, pull
+}
+
+// allows returns an error if the local's mode doesn't allow command
+func (l *Local) allows(command string) error {
+	if (command == "push" && !l.pushes()) || (command == "pull" && !l.pulls()) {
+		return fmt.Errorf("%s refused: '%s' has mode '%s'", command, l.Name, l.mode())
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metered controls what 'gs auto' and 'gs push --all' do with large
+// transfers while the active connection is metered (e.g. tethering), as
+// reported by NetworkManager
+type Metered struct {
+	Policy  string `toml:"policy,omitempty"`   // "ignore" (default), "skip" or "defer"
+	MaxSize string `toml:"max_size,omitempty"` // transfers up to this size still run, e.g. '20M'
+}
+
+// how often and how long 'gs auto' and 'gs push --all' wait by default
+const (
+	defaultInterval = 30 * time.Second
+	defaultTimeout  = 15 * time.Minute
+)
+
+var bwLimitPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGTkmgt]?$`)
+
+func validBwLimit(limit string) error {
+	if limit != "" && !bwLimitPattern.MatchString(limit) {
+		return fmt.Errorf("invalid bwlimit '%s' (expected e.g. '500K' or '2M')", limit)
+	}
+
+	return nil
+}
+
+func (m *Metered) validate() error {
+	switch m.Policy {
+	case "", "ignore", "skip", "defer":
+	default:
+		return fmt.Errorf("invalid metered policy '%s' (expected 'ignore', 'skip' or 'defer')", m.Policy)
+	}
+	if m.MaxSize != "" {
+		if _, err := parseSize(m.MaxSize); err != nil {
+			return fmt.Errorf("invalid metered max_size: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Metered) active() bool {
+	return m.Policy == "skip" || m.Policy == "defer"
+}
+
+// limit returns the largest transfer that still runs on a metered connection;
+// without max_size there's no exemption, so only empty transfers run
+func (m *Metered) limit() int64 {
+	if m.MaxSize == "" {
+		return 0
+	}
+	size, _ := parseSize(m.MaxSize) // validated on load
+
+	return size
+}
+
+// holds reports whether a transfer of size bytes has to wait for an unmetered
+// connection
+func (m *Metered) holds(size int64) bool {
+	return size > m.limit()
+}
+
+// parseSize parses sizes like '512', '20M' or '1.5GiB' into bytes
+func parseSize(s string) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+	upper := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(trimmed), "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(upper); n > 0 {
+		if i := strings.IndexByte("KMGT", upper[n-1]); i != -1 {
+			multiplier = int64(1) << (10 * (i + 1))
+			upper = upper[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	return int64(value * float64(multiplier)), nil
+}
+
+// NetworkManager's NMMetered values, the guesses are based on the device type
+const (
+	meteredYes      = 1
+	meteredGuessYes = 3
+)
+
+// isMetered asks NetworkManager over D-Bus whether the primary connection is
+// metered; without NetworkManager (or D-Bus tools) it's assumed not to be
+func isMetered() bool {
+	output, err := exec.Command("busctl", "get-property", "org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		output, err = exec.Command("gdbus", "call", "--system", "--dest", "org.freedesktop.NetworkManager",
+			"--object-path", "/org/freedesktop/NetworkManager",
+			"--method", "org.freedesktop.DBus.Properties.Get", "org.freedesktop.NetworkManager", "Metered").Output()
+	}
+	if err != nil {
+		return false
+	}
+
+	value, ok := parseMeteredProperty(string(output))
+	return ok && (value == meteredYes || value == meteredGuessYes)
+}
+
+var dbusUintPattern = regexp.MustCompile(`^(?:u |\(<uint32 )(\d+)`)
+
+// parseMeteredProperty reads the value from busctl ('u 4') or gdbus
+// ('(<uint32 4>,)') output
+func parseMeteredProperty(output string) (int, bool) {
+	m := dbusUintPattern.FindStringSubmatch(strings.TrimSpace(output))
+	if m == nil {
+		return 0, false
+	}
+	value, err := strconv.Atoi(m[1])
+
+	return value, err == nil
+}
+
+// pendingSize returns how many bytes a push or pull of the local would
+// transfer
+func pendingSize(cfg *Config, local *Local, command string) (int64, error) {
+	root, err := syncRoot(cfg, local)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := cfg.rsyncOptions(local)
+	opts.Delete = local.deletes()
+	opts.DryRun = true
+	opts.Stats = true
+	src, dst := cfg.RemoteForLocal(local), root
+	if command == "push" {
+		src, dst = root, src
+	}
+	result, err := runRsync(src, dst, opts)
+	if command == "push" && errors.Is(err, ErrRemoteNotFound) {
+		// the first push uploads everything
+		files, err := snapshotLocal(root, "", opts.Excludes)
+		var size int64
+		for _, state := range files {
+			size += state.Size
+		}
+		return size, err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Stats.TransferSize, nil
+}
+
+// meteredHold reports whether the push or pull of local is too large to run
+// on the metered connection right now
+func meteredHold(cfg *Config, local *Local, command string) (bool, error) {
+	size, err := pendingSize(cfg, local, command)
+	if err != nil {
+		return false, err
+	}
+	if !cfg.Metered.holds(size) {
+		return false, nil
+	}
+
+	limit := "no max_size set"
+	if cfg.Metered.MaxSize != "" {
+		limit = "limit " + formatSize(cfg.Metered.limit())
+	}
+	logWarn("connection is metered and '%s' has %s to %s (%s)", local.Name, formatSize(size), command, limit)
+
+	return true, nil
+}
+
+// syncMetered runs sync (a push or pull, per command) for each of locals.
+// while the connection is metered and the policy is active, locals with too
+// much to transfer are skipped or, with "defer", synced once it isn't metered
+// anymore. it returns the names of the locals that failed
+func syncMetered(cfg *Config, locals []*Local, command string, interval, timeout time.Duration, sync func(*Local) error) []string {
+	metered := cfg.Metered.active() && isMetered()
+	if metered {
+		logWarn("connection is metered, large %ss will be %s", command, map[string]string{"skip": "skipped", "defer": "deferred"}[cfg.Metered.Policy])
+	}
+
+	var failed []string
+	var deferred []*Local
+	for _, local := range locals {
+		if metered {
+			hold, err := meteredHold(cfg, local, command)
+			if err != nil {
+				logError("failed to check '%s': %s", local.Name, err)
+				notifyFailure(cfg, command, local.Name, err)
+				failed = append(failed, local.Name)
+				continue
+			}
+			if hold && cfg.Metered.Policy == "skip" {
+				logWarn("skipping '%s' until the next run", local.Name)
+				continue
+			}
+			if hold {
+				deferred = append(deferred, local)
+				continue
+			}
+		}
+
+		if err := sync(local); err != nil {
+			logError("failed to %s '%s': %s", command, local.Name, err)
+			failed = append(failed, local.Name)
+		}
+	}
+
+	if len(deferred) > 0 {
+		logProgress("waiting for an unmetered connection to %s %d deferred local(s)...", command, len(deferred))
+		if err := waitForUnmetered(interval, timeout); err != nil {
+			logWarn("%s", err)
+			for _, local := range deferred {
+				failed = append(failed, local.Name)
+				notifyFailure(cfg, command, local.Name, err)
+			}
+			deferred = nil
+		}
+		for _, local := range deferred {
+			if err := sync(local); err != nil {
+				logError("failed to %s '%s': %s", command, local.Name, err)
+				failed = append(failed, local.Name)
+			}
+		}
+	}
+
+	return failed
+}
+
+// waitForUnmetered polls until the connection isn't metered anymore
+func waitForUnmetered(interval, timeout time.Duration) error {
+	start := time.Now()
+	for isMetered() {
+		if timeout > 0 && time.Since(start) >= timeout {
+			return fmt.Errorf("timeout waiting for an unmetered connection")
+		}
+		time.Sleep(interval)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// notifiers tell someone about the outcome of pushes and pulls, mostly for
+// unattended runs of 'gs auto' whose output nobody reads:
+//
+//	[[notifiers]]
+//	name = "desktop"
+//	type = "desktop"
+//	events = ["failure", "conflict"]
+
+type Notifier struct {
+	Name    string   `toml:"name"`
+	Type    string   `toml:"type"`              // "desktop", "webhook" or "command"
+	URL     string   `toml:"url,omitempty"`     // webhook receiving the event as json
+	Command string   `toml:"command,omitempty"` // run with sh, gets the event in $GS_* and as json on stdin
+	Events  []string `toml:"events,omitempty"`  // default: all but "success"
+}
+
+const (
+	eventSuccess          = "success"
+	eventFailure          = "failure"
+	eventConflict         = "conflict"
+	eventDeletionsBlocked = "deletions_blocked"
+)
+
+var allEvents = []string{eventSuccess, eventFailure, eventConflict, eventDeletionsBlocked}
+
+const notifyTimeout = 10 * time.Second
+
+func (n *Notifier) validate() error {
+	if n.Name == "" {
+		return fmt.Errorf("notifiers need a name")
+	}
+	switch n.Type {
+	case "desktop":
+	case "webhook":
+		if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notifier '%s': invalid url '%s'", n.Name, n.URL)
+		}
+	case "command":
+		if n.Command == "" {
+			return fmt.Errorf("notifier '%s': 'command' must be set", n.Name)
+		}
+	default:
+		return fmt.Errorf("notifier '%s': invalid type '%s' (expected 'desktop', 'webhook' or 'command')", n.Name, n.Type)
+	}
+	for _, event := range n.Events {
+		if !slices.Contains(allEvents, event) {
+			return fmt.Errorf("notifier '%s': invalid event '%s' (expected one of %s)", n.Name, event, strings.Join(allEvents, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (n *Notifier) wants(event string) bool {
+	if len(n.Events) == 0 {
+		return event != eventSuccess
+	}
+
+	return slices.Contains(n.Events, event)
+}
+
+type syncEvent struct {
+	Event   string    `json:"event"`
+	Command string    `json:"command"`
+	Local   string    `json:"local,omitempty"`
+	Device  string    `json:"device"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// eventFor classifies the outcome of a push or pull
+func eventFor(report *syncReport, err error) syncEvent {
+	e := syncEvent{Command: report.Command, Local: report.Local, Time: time.Now()}
+	switch {
+	case err == nil:
+		e.Event = eventSuccess
+		e.Message = fmt.Sprintf("%s of '%s' complete (%d file(s) transferred, %d deleted)", report.Command, report.Local, report.Stats.Files, report.Stats.Deleted)
+		return e
+	case errors.Is(err, ErrRemoteChanged), errors.Is(err, ErrLocalChanged):
+		e.Event = eventConflict
+	case errors.Is(err, ErrTooManyDeletions):
+		e.Event = eventDeletionsBlocked
+	default:
+		e.Event = eventFailure
+	}
+	reason, _, _ := strings.Cut(err.Error(), "\n")
+	e.Message = fmt.Sprintf("%s of '%s' failed: %s", report.Command, report.Local, reason)
+
+	return e
+}
+
+// notifyResult sends the outcome of a push or pull to the notifiers
+func notifyResult(cfg *Config, report *syncReport, err error) {
+	if report.DryRun {
+		return
+	}
+	notify(cfg, eventFor(report, err))
+}
+
+// notifyFailure reports errors of 'gs auto' and 'gs push --all' that happen
+// outside of a push or pull, e.g. while waiting for the server
+func notifyFailure(cfg *Config, command, local string, err error) {
+	e := syncEvent{Event: eventFailure, Command: command, Local: local, Message: fmt.Sprintf("%s failed: %s", command, err), Time: time.Now()}
+	if local != "" {
+		e.Message = fmt.Sprintf("%s of '%s' failed: %s", command, local, err)
+	}
+	notify(cfg, e)
+}
+
+func notify(cfg *Config, e syncEvent) {
+	e.Device = cfg.deviceName()
+	for i := range cfg.Notifiers {
+		n := &cfg.Notifiers[i]
+		if !n.wants(e.Event) {
+			continue
+		}
+
+		var err error
+		switch n.Type {
+		case "desktop":
+			err = notifyDesktop(e)
+		case "webhook":
+			err = notifyWebhook(n.URL, e)
+		case "command":
+			err = notifyCommand(n.Command, e)
+		}
+		if err != nil {
+			logWarn("failed to notify '%s': %s", n.Name, err)
+		}
+	}
+}
+
+// notifyDesktop shows a freedesktop notification over the session bus
+func notifyDesktop(e syncEvent) error {
+	summary := "gs: " + strings.ReplaceAll(e.Event, "_", " ")
+	// anything but success is critical and stays on screen until dismissed
+	urgency, expire := "1", "10000"
+	if e.Event != eventSuccess {
+		urgency, expire = "2", "0"
+	}
+
+	output, err := exec.Command("busctl", "--user", "call", "org.freedesktop.Notifications",
+		"/org/freedesktop/Notifications", "org.freedesktop.Notifications", "Notify", "susssasa{sv}i",
+		"gs", "0", "", summary, e.Message, "0", "1", "urgency", "y", urgency, expire).CombinedOutput()
+	if err != nil {
+		output, err = exec.Command("gdbus", "call", "--session", "--dest", "org.freedesktop.Notifications",
+			"--object-path", "/org/freedesktop/Notifications", "--method", "org.freedesktop.Notifications.Notify",
+			"gs", "0", "", summary, e.Message, "[]", "{'urgency': <byte "+urgency+">}", expire).CombinedOutput()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func notifyWebhook(u string, e syncEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func notifyCommand(command string, e syncEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"GS_EVENT="+e.Event,
+		"GS_COMMAND="+e.Command,
+		"GS_LOCAL="+e.Local,
+		"GS_MESSAGE="+e.Message,
+	)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.WaitDelay = time.Second // don't wait for children holding the output open
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
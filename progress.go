@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// live transfers stream rsync's output as it arrives; '--info=progress2'
+// makes rsync report the progress of the whole transfer, which is drawn as a
+// single updating line on terminals and logged periodically otherwise
+
+const progressLogInterval = 30 * time.Second
+
+type transferProgress struct {
+	Bytes   int64
+	Percent int
+	Rate    string // as formatted by rsync, e.g. '1.23MB/s'
+	ETA     string
+	Done    int // files checked so far
+	Total   int // files to check, grows while rsync is still scanning
+}
+
+// e.g. '  1,234,567  45%   12.34MB/s    0:00:12 (xfr#3, to-chk=10/20)'
+var progressPattern = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%\s+(\S+)\s+(\S+)(?:\s+\(xfr#\d+, (?:to|ir)-chk=(\d+)/(\d+)\))?\s*$`)
+
+func parseProgressLine(line string) (transferProgress, bool) {
+	m := progressPattern.FindStringSubmatch(line)
+	if m == nil {
+		return transferProgress{}, false
+	}
+
+	p := transferProgress{Rate: m[3], ETA: m[4]}
+	p.Bytes, _ = strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+	p.Percent, _ = strconv.Atoi(m[2])
+	if m[6] != "" {
+		remaining, _ := strconv.Atoi(m[5])
+		p.Total, _ = strconv.Atoi(m[6])
+		p.Done = p.Total - remaining
+	}
+
+	return p, true
+}
+
+func (p transferProgress) String() string {
+	s := fmt.Sprintf("%3d%% %s at %s, eta %s", p.Percent, formatSize(p.Bytes), p.Rate, p.ETA)
+	if p.Total > 0 {
+		s += fmt.Sprintf(", %d/%d files", p.Done, p.Total)
+	}
+
+	return s
+}
+
+type progressPrinter struct {
+	w       io.Writer
+	tty     bool
+	last    transferProgress
+	drawn   bool // a progress line is on screen and has to be cleared first
+	lastLog time.Time
+}
+
+func newProgressPrinter(w *os.File) *progressPrinter {
+	// with '-q' the progress only goes to the log file, like off a terminal
+	tty := isTerminal(w) && consoleEnabled(slog.LevelInfo)
+
+	return &progressPrinter{w: w, tty: tty, lastLog: time.Now()}
+}
+
+func (p *progressPrinter) line(s string) {
+	p.clear()
+	fmt.Fprintln(p.w, s)
+	if p.drawn {
+		p.draw()
+	}
+}
+
+func (p *progressPrinter) update(progress transferProgress) {
+	p.last = progress
+	if p.tty {
+		p.drawn = true
+		p.draw()
+		return
+	}
+	if time.Since(p.lastLog) >= progressLogInterval {
+		p.lastLog = time.Now()
+		logProgress("progress: %s", progress)
+	}
+}
+
+func (p *progressPrinter) clear() {
+	if p.tty && p.drawn {
+		fmt.Fprint(p.w, "\r\033[K")
+	}
+}
+
+func (p *progressPrinter) draw() {
+	fmt.Fprintf(p.w, "\r\033[K[~] %s", p.last)
+}
+
+func (p *progressPrinter) finish() {
+	p.clear()
+	p.drawn = false
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// splitLines is bufio.ScanLines that also splits on carriage returns, which
+// rsync uses to overwrite progress lines
+func splitLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// runLive runs rsync, printing its output as it arrives and returning it
+// without progress lines, like CombinedOutput would
+func runLive(cmd *exec.Cmd, translate func(string) string) ([]byte, error) {
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		done <- err
+	}()
+
+	printer := newProgressPrinter(os.Stdout)
+	var output bytes.Buffer
+	scanner := bufio.NewScanner(pr)
+	scanner.Split(splitLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if progress, ok := parseProgressLine(line); ok {
+			printer.update(progress)
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		output.WriteString(line + "\n")
+		if !isStatsLine(line) && consoleEnabled(slog.LevelInfo) {
+			printer.line(translate(line))
+		}
+	}
+	printer.finish()
+	io.Copy(io.Discard, pr) // an overlong line stops the scanner, let rsync finish
+
+	return output.Bytes(), <-done
+}
+
+var rsyncVersion = sync.OnceValues(func() (major, minor int) {
+	output, err := exec.Command("rsync", "--version").Output()
+	if err != nil {
+		return 0, 0
+	}
+	m := regexp.MustCompile(`version (\d+)\.(\d+)`).FindStringSubmatch(string(output))
+	if m == nil {
+		return 0, 0
+	}
+	major, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+
+	return major, minor
+})
+
+// supportsProgress2 reports whether rsync knows '--info=progress2' (3.1+),
+// older versions and openrsync only get their output streamed
+func supportsProgress2() bool {
+	major, minor := rsyncVersion()
+	return major > 3 || (major == 3 && minor >= 1)
+}
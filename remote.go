@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -47,22 +49,137 @@ func waitForServer(host, port string, interval, timeout time.Duration) error {
 type RsyncResult struct {
 	Output  string
 	Changes []string
+	Stats   rsyncStats // only set if requested in the options
 }
 
-func runRsync(src, dst, port string, excludes []string, dryRun, del bool) (*RsyncResult, error) {
-	sshCmd := fmt.Sprintf("ssh -p %s %s", port, sshOptions)
+type rsyncStats struct {
+	FilesTransferred int
+	TransferSize     int64 // total size of the transferred files
+	BytesSent        int64
+	BytesReceived    int64
+}
+
+type rsyncOptions struct {
+	Port     string
+	Excludes []string
+	DryRun   bool
+	Delete   bool
+	Update   bool     // skip files that are newer on the receiver
+	Checksum bool     // compare file contents instead of size and modification time
+	BwLimit  string   // bandwidth limit in rsync's format, e.g. '500K' or '2M'
+	Stats    bool     // collect transfer statistics
+	Live     bool     // print output and progress while transferring
+	Paths    []string // limit the transfer to these paths relative to src and dst
+	Symlinks string   // symlink policy, see metadata.go
+	Chmod    string   // permissions of transferred files, empty to preserve them
+	Owner    bool     // preserve owner and group
+	MaxSize  int64    // skip larger files, 0 for no limit
+	MinSize  int64    // skip smaller files, 0 for no limit
+
+	// paths missing in src are deleted in dst (with Delete) or skipped,
+	// instead of failing the transfer
+	MissingPaths bool
+
+	Encrypted bool         // the local side is a staging directory of an encrypted local
+	Cipher    *localCipher // maps paths between their plain and encrypted names
+}
+
+// rsyncOptions returns the options shared by every transfer of the local
+func (c *Config) rsyncOptions(l *Local) rsyncOptions {
+	opts := rsyncOptions{
+		Port:     c.Port,
+		Excludes: c.ExcludesForLocal(l),
+		Checksum: l.Checksum,
+		BwLimit:  c.BwLimit,
+		Symlinks: l.Symlinks,
+		Chmod:    l.chmod(),
+		Owner:    l.Owner,
+	}
+	if l.MaxFileSize != "" {
+		opts.MaxSize, _ = parseSize(l.MaxFileSize) // validated on load
+	}
+	if l.BwLimit != "" {
+		opts.BwLimit = l.BwLimit
+	}
+	if l.Encrypt {
+		// excludes were applied when staging, they can't match encrypted names
+		opts.Excludes = nil
+		opts.Encrypted = true
+		opts.Cipher = l.cipher
+	}
+
+	return opts
+}
+
+func runRsync(src, dst string, opts rsyncOptions) (*RsyncResult, error) {
+	if opts.Encrypted && opts.Cipher == nil {
+		return nil, fmt.Errorf("encrypted local hasn't been unlocked")
+	}
+
+	sshCmd := fmt.Sprintf("ssh -p %s %s", opts.Port, sshOptions)
 	args := []string{"-avz", "-e", sshCmd}
 
-	if dryRun {
-		args = append(args, "--dry-run", "--itemize-changes")
+	// itemized changes are parsed for reports and printed for the user
+	args = append(args, "--itemize-changes")
+	if opts.DryRun {
+		args = append(args, "--dry-run")
 	}
 
-	if del {
+	if opts.Delete {
 		args = append(args, "--delete")
 	}
 
-	if len(excludes) > 0 {
-		excludeFile, err := writeExcludeFile(excludes)
+	// -a preserves all of these, the local's policies take some back
+	if !opts.Owner {
+		args = append(args, "--no-owner", "--no-group")
+	}
+	switch opts.Symlinks {
+	case symlinksFollow:
+		args = append(args, "--copy-links")
+	case symlinksSkip:
+		args = append(args, "--no-links")
+	}
+	if opts.Chmod != "" {
+		args = append(args, "--chmod="+opts.Chmod)
+	}
+
+	if opts.MaxSize > 0 {
+		args = append(args, fmt.Sprintf("--max-size=%d", opts.MaxSize))
+	}
+	if opts.MinSize > 0 {
+		args = append(args, fmt.Sprintf("--min-size=%d", opts.MinSize))
+	}
+
+	// interrupted transfers continue from the partially transferred files.
+	// partial dirs are excluded explicitly, as rsync only does that itself
+	// without other exclude rules, so they're never transferred or deleted
+	if !opts.DryRun {
+		args = append(args, "--partial-dir="+partialDir)
+	}
+	args = append(args, "--exclude="+partialDir+"/")
+
+	if opts.Update {
+		args = append(args, "--update")
+	}
+
+	if opts.Checksum {
+		args = append(args, "--checksum")
+	}
+
+	if opts.BwLimit != "" {
+		args = append(args, "--bwlimit="+opts.BwLimit)
+	}
+
+	if opts.Stats {
+		args = append(args, "--stats")
+	}
+
+	if opts.Live && supportsProgress2() {
+		args = append(args, "--info=progress2")
+	}
+
+	if len(opts.Excludes) > 0 {
+		excludeFile, err := writeExcludeFile(opts.Excludes)
 		if err != nil {
 			return nil, err
 		}
@@ -70,17 +187,45 @@ func runRsync(src, dst, port string, excludes []string, dryRun, del bool) (*Rsyn
 		args = append(args, "--exclude-from="+excludeFile)
 	}
 
-	if !strings.HasSuffix(src, "/") {
-		src += "/"
-	}
+	src = strings.TrimSuffix(src, "/")
 	if !strings.HasSuffix(dst, "/") {
 		dst += "/"
 	}
 
-	args = append(args, src, dst)
+	if len(opts.Paths) > 0 && opts.MissingPaths {
+		if opts.Delete {
+			args = append(args, "--delete-missing-args")
+		} else {
+			args = append(args, "--ignore-missing-args")
+		}
+	}
+
+	if len(opts.Paths) > 0 {
+		// the '/./' marks where the path recreated at dst starts
+		args = append(args, "--relative")
+		for _, p := range opts.Paths {
+			if opts.Cipher != nil {
+				var err error
+				if p, err = opts.Cipher.encryptPath(p); err != nil {
+					return nil, err
+				}
+			}
+			args = append(args, src+"/./"+p)
+		}
+	} else {
+		args = append(args, src+"/")
+	}
+	args = append(args, dst)
 
+	logDebug("running rsync %s", strings.Join(args, " "))
 	cmd := exec.Command("rsync", args...)
-	output, err := cmd.CombinedOutput()
+	var output []byte
+	var err error
+	if opts.Live {
+		output, err = runLive(cmd, opts.translateLine)
+	} else {
+		output, err = cmd.CombinedOutput()
+	}
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			switch exitErr.ExitCode() {
@@ -95,14 +240,30 @@ func runRsync(src, dst, port string, excludes []string, dryRun, del bool) (*Rsyn
 		return nil, fmt.Errorf("rsync failed: %w\n%s", err, string(output))
 	}
 
-	result := &RsyncResult{Output: string(output)}
-	if dryRun {
-		result.Changes = parseItemizedChanges(string(output))
+	result := &RsyncResult{Output: string(output), Changes: parseItemizedChanges(string(output))}
+	if opts.Stats {
+		result.Stats = parseRsyncStats(string(output))
+	}
+	if opts.Cipher != nil {
+		result.Output = opts.Cipher.decryptOutput(result.Output)
+		result.Changes = opts.Cipher.decryptChanges(result.Changes)
 	}
 
 	return result, nil
 }
 
+// translateLine maps encrypted names in a line of rsync output to plain ones
+func (o rsyncOptions) translateLine(line string) string {
+	if o.Cipher == nil {
+		return line
+	}
+	if changes := parseItemizedChanges(line); len(changes) == 1 {
+		return o.Cipher.decryptChanges(changes)[0]
+	}
+
+	return o.Cipher.decryptOutput(line)
+}
+
 func writeExcludeFile(excludes []string) (string, error) {
 	f, err := os.CreateTemp("", "gs-excludes-*")
 	if err != nil {
@@ -124,7 +285,9 @@ func parseItemizedChanges(output string) []string {
 		if len(line) < 12 {
 			continue
 		}
-		if line[0] == '<' || line[0] == '>' || line[0] == '*' || line[0] == 'c' {
+		// the second character is the file type, which tells changes apart
+		// from messages like 'created directory ...'
+		if isDeletion(line) || (strings.ContainsRune("<>c", rune(line[0])) && strings.ContainsRune("fdLDS", rune(line[1]))) {
 			changes = append(changes, line)
 		}
 	}
@@ -132,9 +295,105 @@ func parseItemizedChanges(output string) []string {
 	return changes
 }
 
-func checkRemoteChanges(cfg *Config, local *Local) ([]string, error) {
+// isStatsLine tells the lines added by '--stats' apart from the rest of the
+// output, which is shown to the user while the summary is only parsed
+func isStatsLine(line string) bool {
+	for _, prefix := range []string{"Number of ", "Total ", "Literal data:", "Matched data:", "File list "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRsyncStats reads the summary printed with '--stats', ignoring lines
+// it doesn't know (their set differs between rsync versions)
+func parseRsyncStats(output string) rsyncStats {
+	var stats rsyncStats
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// e.g. 'Total bytes sent: 1,234' or 'Number of regular files transferred: 3'
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.ReplaceAll(fields[0], ",", ""), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch strings.TrimSpace(key) {
+		case "Number of regular files transferred", "Number of files transferred":
+			stats.FilesTransferred = int(n)
+		case "Total transferred file size":
+			stats.TransferSize = n
+		case "Total bytes sent":
+			stats.BytesSent = n
+		case "Total bytes received":
+			stats.BytesReceived = n
+		}
+	}
+
+	return stats
+}
+
+// itemized change lines look like '>f.st...... path' or '*deleting   path',
+// i.e. an 11 character change summary followed by the path
+
+func changePath(change string) string {
+	if len(change) <= 11 {
+		return ""
+	}
+
+	return strings.TrimLeft(change[11:], " ")
+}
+
+func isDeletion(change string) bool {
+	return strings.HasPrefix(change, "*deleting")
+}
+
+func isNewItem(change string) bool {
+	return len(change) > 11 && strings.Trim(change[2:11], "+") == ""
+}
+
+// isDestructive reports whether applying the change loses data on the
+// receiving side, i.e. deletes or overwrites an existing file
+func isDestructive(change string) bool {
+	if isDeletion(change) {
+		return true
+	}
+
+	return (change[0] == '<' || change[0] == '>') && change[1] == 'f' && !isNewItem(change)
+}
+
+func describeChange(change string) string {
+	kind := "modified"
+	switch {
+	case isDeletion(change):
+		kind = "deleted"
+	case isNewItem(change):
+		kind = "new"
+	case !isDestructive(change):
+		kind = "changed"
+	}
+
+	return fmt.Sprintf("%-9s %s", kind, changePath(change))
+}
+
+// checkRemoteChanges lists remote changes a push would overwrite, limited to
+// the paths of the push if any are given
+func checkRemoteChanges(cfg *Config, local *Local, syncOpts syncOptions) ([]string, error) {
 	remote := cfg.RemoteForLocal(local)
-	result, err := runRsync(remote, local.Path, cfg.Port, cfg.Excludes, true, false)
+	opts := cfg.rsyncOptions(local)
+	opts.DryRun = true
+	opts.Paths = syncOpts.Paths
+	opts.MissingPaths = true // paths only pushed to delete them may be gone on both sides
+	opts.Checksum = opts.Checksum || syncOpts.Checksum
+	result, err := runRsync(remote, transferRoot(local), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -142,3 +401,174 @@ func checkRemoteChanges(cfg *Config, local *Local) ([]string, error) {
 	return result.Changes, nil
 }
 
+// shellQuote quotes s for safe use in a remote sh command line
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runSSH runs script with sh on the server and returns its stdout
+func runSSH(cfg *Config, script string) (string, error) {
+	return runSSHInput(cfg, script, nil)
+}
+
+func runSSHInput(cfg *Config, script string, stdin io.Reader) (string, error) {
+	args := append([]string{"-p", cfg.Port}, strings.Fields(sshOptions)...)
+	args = append(args, cfg.Server, "sh -c "+shellQuote(script))
+
+	logDebug("running on %s: %s", cfg.Server, script)
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = stdin
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 255 {
+			return "", fmt.Errorf("ssh connection failed (check pubkey auth): %s", stderr.String())
+		}
+		return "", fmt.Errorf("remote command failed: %w\n%s", err, stderr.String())
+	}
+
+	return string(output), nil
+}
+
+func (c *Config) remoteDirPath(dir string) string {
+	return c.RemotePath + "/" + dir
+}
+
+func remoteDirExists(cfg *Config, dir string) (bool, error) {
+	output, err := runSSH(cfg, fmt.Sprintf("if [ -d %s ]; then echo yes; else echo no; fi", shellQuote(cfg.remoteDirPath(dir))))
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(output) == "yes", nil
+}
+
+type RemoteDir struct {
+	Name     string
+	Size     int64 // bytes
+	Files    int
+	Modified time.Time // newest file, zero for empty directories
+}
+
+// stat flags differ between GNU and BSD userlands, so both are tried
+const listRemoteDirsScript = `cd %s 2>/dev/null || exit 0
+for d in */; do
+	[ -d "$d" ] || continue
+	d=${d%%/}
+	size=$(du -sk "$d" | cut -f1)
+	files=$(find "$d" -type f | wc -l)
+	mtime=$( (find "$d" -type f -exec stat -c %%Y {} + 2>/dev/null || find "$d" -type f -exec stat -f %%m {} +) | sort -n | tail -1)
+	printf '%%s\t%%s\t%%s\t%%s\n' "$size" "$files" "${mtime:-0}" "$d"
+done`
+
+func listRemoteDirs(cfg *Config) ([]RemoteDir, error) {
+	output, err := runSSH(cfg, fmt.Sprintf(listRemoteDirsScript, shellQuote(cfg.RemotePath)))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRemoteDirs(output)
+}
+
+func parseRemoteDirs(output string) ([]RemoteDir, error) {
+	var dirs []RemoteDir
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected remote listing line: %q", line)
+		}
+
+		sizeKB, err1 := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		files, err2 := strconv.Atoi(strings.TrimSpace(fields[1]))
+		mtime, err3 := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return nil, fmt.Errorf("unexpected remote listing line: %q", line)
+		}
+
+		dir := RemoteDir{Name: fields[3], Size: sizeKB * 1024, Files: files}
+		if mtime > 0 {
+			dir.Modified = time.Unix(mtime, 0)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return dirs, nil
+}
+
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%c", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+var ErrRemoteExists = errors.New("remote directory already exists")
+
+const moveRemoteDirScript = `src=%s; dst=%s
+if [ -e "$dst" ]; then echo exists; exit 0; fi
+if [ ! -d "$src" ]; then echo missing; exit 0; fi
+mkdir -p "$(dirname "$dst")" && mv "$src" "$dst" && echo moved`
+
+// moveRemoteDir renames a directory under the remote path, returning false if
+// there was nothing to move (e.g. the local was never pushed)
+func moveRemoteDir(cfg *Config, src, dst string) (bool, error) {
+	script := fmt.Sprintf(moveRemoteDirScript, shellQuote(cfg.remoteDirPath(src)), shellQuote(cfg.remoteDirPath(dst)))
+	output, err := runSSH(cfg, script)
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.TrimSpace(output) {
+	case "moved":
+		return true, nil
+	case "missing":
+		return false, nil
+	case "exists":
+		return false, fmt.Errorf("%w: %s", ErrRemoteExists, cfg.remoteDirPath(dst))
+	default:
+		return false, fmt.Errorf("unexpected output from remote: %q", output)
+	}
+}
+
+// makeRemoteParent creates the parents of a remote directory, e.g. 'notes' for
+// a 'notes/pdfs' remote_subdir, since rsync only creates the last one
+func makeRemoteParent(cfg *Config, dir string) error {
+	_, err := runSSH(cfg, fmt.Sprintf(`mkdir -p "$(dirname %s)"`, shellQuote(cfg.remoteDirPath(dir))))
+	return err
+}
+
+func removeRemoteDir(cfg *Config, dir string) error {
+	_, err := runSSH(cfg, "rm -rf "+shellQuote(cfg.remoteDirPath(dir)))
+	return err
+}
+
+// listRemoteFiles returns the paths of all files and directories inside dir,
+// relative to it
+func listRemoteFiles(cfg *Config, dir string) ([]string, error) {
+	output, err := runSSH(cfg, fmt.Sprintf("cd %s 2>/dev/null || exit 0; find . -mindepth 1", shellQuote(cfg.remoteDirPath(dir))))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" {
+			files = append(files, strings.TrimPrefix(line, "./"))
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encrypted locals aren't transferred directly: pushing first encrypts them
+// into a staging directory mirroring the remote one, which rsync then
+// transfers as usual, and pulling decrypts what rsync brought into it. a
+// manifest records the state of both copies of every file, so only files
+// changed on either side are encrypted or decrypted again
+
+type stagedFile struct {
+	Path   string    `json:"path"` // relative to the staging directory
+	Plain  fileState `json:"plain"`
+	Staged fileState `json:"staged"`
+}
+
+type stagingManifest map[string]stagedFile // keyed by plain relative path
+
+func stagingDir(l *Local) string {
+	return filepath.Join(stateDir(), "staging", fmt.Sprintf("%s-%x", l.Name, hashString(configPath())))
+}
+
+func manifestPath(l *Local) string {
+	return stagingDir(l) + ".json"
+}
+
+func loadManifest(l *Local) (stagingManifest, error) {
+	m := make(stagingManifest)
+	data, err := os.ReadFile(manifestPath(l))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse staging manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+func saveManifest(l *Local, m stagingManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := manifestPath(l) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, manifestPath(l))
+}
+
+// transferRoot returns the directory rsync transfers for the local
+func transferRoot(l *Local) string {
+	if l.Encrypt {
+		return stagingDir(l)
+	}
+
+	return l.Path
+}
+
+// syncRoot prepares the local for a transfer and returns its transfer root;
+// encrypted locals are unlocked and their staging directory brought up to date
+func syncRoot(cfg *Config, l *Local) (string, error) {
+	if !l.Encrypt {
+		return l.Path, nil
+	}
+
+	if err := unlockLocal(cfg, l); err != nil {
+		return "", err
+	}
+	if err := stageLocal(cfg, l); err != nil {
+		return "", fmt.Errorf("failed to encrypt '%s': %w", l.Name, err)
+	}
+
+	return stagingDir(l), nil
+}
+
+// stageLocal encrypts new and changed files of the local into its staging
+// directory and removes everything there that no longer exists locally
+func stageLocal(cfg *Config, l *Local) error {
+	dir := stagingDir(l)
+	m, err := loadManifest(l)
+	if err != nil {
+		return err
+	}
+
+	current, err := snapshotLocal(l.Path, "", cfg.ExcludesForLocal(l))
+	if err != nil {
+		return err
+	}
+
+	for rel, state := range current {
+		if rel == keyParamsFile {
+			logWarn("skipping '%s', the name is reserved for encrypted locals", rel)
+			continue
+		}
+
+		entry, ok := m[rel]
+		if ok && entry.Plain == state && stagedUnchanged(dir, entry) {
+			continue
+		}
+
+		staged, err := l.cipher.encryptPath(rel)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(staged))
+		if err := transformFile(filepath.Join(l.Path, filepath.FromSlash(rel)), dst, l.cipher.encrypt); err != nil {
+			return err
+		}
+
+		info, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		m[rel] = stagedFile{Path: staged, Plain: state, Staged: stateOf(info)}
+	}
+
+	for rel := range m {
+		if _, ok := current[rel]; !ok {
+			delete(m, rel)
+		}
+	}
+	if err := cleanStaging(dir, m); err != nil {
+		return err
+	}
+
+	return saveManifest(l, m)
+}
+
+func stagedUnchanged(dir string, entry stagedFile) bool {
+	info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+	return err == nil && stateOf(info) == entry.Staged
+}
+
+// cleanStaging removes files missing from the manifest and empty directories;
+// partial dirs are kept, so interrupted pulls can resume
+func cleanStaging(dir string, m stagingManifest) error {
+	known := make(map[string]bool, len(m)+1)
+	known[keyParamsFile] = true
+	for _, entry := range m {
+		known[entry.Path] = true
+	}
+
+	var dirs []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == partialDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+		} else if !known[filepath.ToSlash(rel)] {
+			return os.Remove(p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// deepest first, removing a non-empty directory just fails
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+
+	return nil
+}
+
+// unstageLocal decrypts files rsync changed in the staging directory into the
+// local, and deletes local files whose staged copy rsync deleted
+func unstageLocal(cfg *Config, l *Local) error {
+	dir := stagingDir(l)
+	m, err := loadManifest(l)
+	if err != nil {
+		return err
+	}
+	excludes := cfg.ExcludesForLocal(l)
+
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// partial dirs of interrupted pulls can be in any directory
+		if d.IsDir() && d.Name() == partialDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return nil
+		}
+		staged, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		staged = filepath.ToSlash(staged)
+		if staged == keyParamsFile {
+			return nil
+		}
+
+		rel, err := l.cipher.decryptPath(staged)
+		if err != nil {
+			logWarn("skipping '%s': %s", staged, err)
+			return nil
+		}
+		if excludedPath(rel, excludes) {
+			return nil
+		}
+		seen[rel] = true
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry, ok := m[rel]
+		if ok && entry.Staged == stateOf(info) {
+			return nil
+		}
+
+		dst := filepath.Join(l.Path, filepath.FromSlash(rel))
+		if err := transformFile(p, dst, l.cipher.decrypt); err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", rel, err)
+		}
+		plain, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		m[rel] = stagedFile{Path: staged, Plain: stateOf(plain), Staged: stateOf(info)}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for rel := range m {
+		if seen[rel] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.Path, filepath.FromSlash(rel))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		delete(m, rel)
+	}
+
+	return saveManifest(l, m)
+}
+
+// excludedPath checks a file path and all of its parent directories
+func excludedPath(rel string, patterns []string) bool {
+	if isExcluded(rel, false, patterns) {
+		return true
+	}
+	for dir := rel; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndex(dir, "/")]
+		if isExcluded(dir, true, patterns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transformFile writes the encrypted or decrypted src to dst atomically,
+// keeping the permissions and modification time of src
+func transformFile(src, dst string, transform func(w io.Writer, r io.Reader) error) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), ".gs-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if err := transform(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(out.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+}
+
+// decryptTree decrypts every file under src into dst, used to inspect
+// fetched remote copies of encrypted locals
+func decryptTree(c *localCipher, src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// wherever an interrupted transfer left one
+		if d.IsDir() && d.Name() == partialDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return nil
+		}
+		staged, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		staged = filepath.ToSlash(staged)
+		if staged == keyParamsFile {
+			return nil
+		}
+
+		rel, err := c.decryptPath(staged)
+		if err != nil {
+			return err
+		}
+
+		return transformFile(p, filepath.Join(dst, filepath.FromSlash(rel)), c.decrypt)
+	})
+}
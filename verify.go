@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verification hashes every file on both sides, catching divergence that
+// rsync's size and mtime comparison can't see (e.g. bit rot)
+
+// sha256sum is missing on BSD userlands, where shasum does the same
+const selectHashCmd = `if command -v sha256sum >/dev/null 2>&1; then hash=sha256sum; else hash="shasum -a 256"; fi`
+
+// partial dirs of interrupted transfers are left out, see largefiles.go
+const hashRemoteScript = `cd %s 2>/dev/null || { echo missing; exit 0; }
+` + selectHashCmd + `
+find . -type d -name ` + partialDir + ` -prune -o -type f %s -exec $hash {} +`
+
+// hashes the files listed on stdin, one per line
+const hashRemoteFilesScript = `cd %s || exit 1
+` + selectHashCmd + `
+tr '\n' '\0' | xargs -0 $hash`
+
+// stat flags differ between GNU and BSD userlands
+const statRemoteScript = `cd %s 2>/dev/null || { echo missing; exit 0; }
+if stat -c %%s . >/dev/null 2>&1; then
+	find %s -type d -name ` + partialDir + ` -prune -o -type f -exec stat -c '%%s %%Y %%n' {} + 2>/dev/null
+else
+	find %s -type d -name ` + partialDir + ` -prune -o -type f -exec stat -f '%%z %%m %%N' {} + 2>/dev/null
+fi
+exit 0`
+
+// files over 'max_file_size' are never transferred, so neither side's copy is
+// verified; sizeFilter is the find test for the rest
+func sizeFilter(maxSize int64) string {
+	if maxSize <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("! -size +%dc", maxSize)
+}
+
+// withoutLarger drops the files over maxSize, if it's set
+func withoutLarger(states map[string]fileState, maxSize int64) {
+	if maxSize <= 0 {
+		return
+	}
+	for rel, state := range states {
+		if state.Size > maxSize {
+			delete(states, rel)
+		}
+	}
+}
+
+// hashTree returns the sha256 of every regular file under root up to maxSize
+// (0 for no limit), of what links point to with follow
+func hashTree(root string, excludes []string, maxSize int64, follow bool) (map[string]string, error) {
+	states, err := snapshotTree(root, "", excludes, follow)
+	if err != nil {
+		return nil, err
+	}
+	withoutLarger(states, maxSize)
+
+	hashes := make(map[string]string, len(states))
+	for rel := range states {
+		sum, err := hashFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		hashes[rel] = sum
+	}
+
+	return hashes, nil
+}
+
+// hashRemote returns the sha256 of every file in the remote directory up to
+// maxSize (0 for no limit)
+func hashRemote(cfg *Config, dir string, maxSize int64) (map[string]string, error) {
+	output, err := runSSH(cfg, fmt.Sprintf(hashRemoteScript, shellQuote(cfg.remoteDirPath(dir)), sizeFilter(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(output) == "missing" {
+		return nil, ErrRemoteNotFound
+	}
+
+	return parseHashList(output)
+}
+
+// parseHashList parses sha256sum output; names containing a newline or
+// backslash are escaped and the line is prefixed with a backslash
+func parseHashList(output string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, `\`)
+		line = strings.TrimPrefix(line, `\`)
+		if len(line) < 66 || (line[64] != ' ') {
+			return nil, fmt.Errorf("unexpected hash output: %s", line)
+		}
+
+		sum, name := line[:64], line[66:]
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+		}
+		hashes[strings.TrimPrefix(name, "./")] = sum
+	}
+
+	return hashes, nil
+}
+
+type hashMismatch struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // "differs", "local only" or "remote only"
+}
+
+func compareHashes(local, remote map[string]string) []hashMismatch {
+	var mismatches []hashMismatch
+	for rel, sum := range local {
+		remoteSum, ok := remote[rel]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, hashMismatch{rel, "local only"})
+		case remoteSum != sum:
+			mismatches = append(mismatches, hashMismatch{rel, "differs"})
+		}
+	}
+	for rel := range remote {
+		if _, ok := local[rel]; !ok {
+			mismatches = append(mismatches, hashMismatch{rel, "remote only"})
+		}
+	}
+	slices.SortFunc(mismatches, func(a, b hashMismatch) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return mismatches
+}
+
+// withoutKind drops the mismatches of kind
+func withoutKind(mismatches []hashMismatch, kind string) []hashMismatch {
+	var kept []hashMismatch
+	for _, m := range mismatches {
+		if m.Kind != kind {
+			kept = append(kept, m)
+		}
+	}
+
+	return kept
+}
+
+func cmdVerify() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	local, err := getCurrentLocal(cfg)
+	if err != nil {
+		return err
+	}
+
+	// encrypted locals compare their staged ciphertext, which is what the
+	// remote holds
+	root, err := syncRoot(cfg, local)
+	if err != nil {
+		return err
+	}
+	var excludes []string
+	if !local.Encrypt {
+		excludes = cfg.ExcludesForLocal(local)
+	}
+	maxSize := cfg.rsyncOptions(local).MaxSize
+
+	logProgress("hashing local files of '%s'...", local.Name)
+	localHashes, err := hashTree(root, excludes, maxSize, local.followsLinks())
+	if err != nil {
+		return fmt.Errorf("failed to hash local files: %w", err)
+	}
+
+	logProgress("hashing remote files...")
+	remoteHashes, err := hashRemote(cfg, local.RemoteDir(), maxSize)
+	if errors.Is(err, ErrRemoteNotFound) {
+		logWarn("remote directory does not exist yet")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hash remote files: %w", err)
+	}
+	for rel := range remoteHashes {
+		// files the local excludes were never meant to be synced
+		if excludedPath(rel, excludes) {
+			delete(remoteHashes, rel)
+		}
+	}
+
+	mismatches := compareHashes(localHashes, remoteHashes)
+	if !local.deletes() {
+		// append-only pushes leave files that only exist on the remote
+		mismatches = withoutKind(mismatches, "remote only")
+	}
+	if len(mismatches) == 0 {
+		logSuccess("%d files verified, local and remote are identical", len(localHashes))
+		return nil
+	}
+
+	logWarn("%d of %d files don't match:", len(mismatches), len(localHashes))
+	for _, m := range mismatches {
+		rel := m.Path
+		if local.cipher != nil {
+			if plain, err := local.cipher.decryptPath(rel); err == nil {
+				rel = plain
+			}
+		}
+		fmt.Printf("  %-12s %s\n", m.Kind, rel)
+	}
+
+	return fmt.Errorf("verification failed for '%s'", local.Name)
+}
+
+// post-transfer verification compares hash manifests of both sides instead;
+// hashes are cached per side and only recomputed for files whose size or
+// modification time changed, so verifying after every sync stays cheap
+
+type hashedFile struct {
+	State fileState `json:"state"`
+	Hash  string    `json:"hash"`
+}
+
+type hashCache map[string]hashedFile
+
+func hashCachePath(l *Local, side string) string {
+	return filepath.Join(stateDir(), "hashes", fmt.Sprintf("%s-%x-%s.json", l.Name, hashString(configPath()), side))
+}
+
+// loadHashCache returns an empty cache if there's none or it's unreadable,
+// which just means everything gets hashed again
+func loadHashCache(path string) hashCache {
+	cache := make(hashCache)
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &cache); err != nil {
+			return make(hashCache)
+		}
+	}
+
+	return cache
+}
+
+func saveHashCache(path string, cache hashCache) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func inScope(rel string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = strings.TrimSuffix(p, "/")
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hashWithCache returns the hashes of the files in states, only hashing the
+// ones not in the cache at path with the same state
+func hashWithCache(path string, paths []string, states map[string]fileState, hash func([]string) (map[string]string, error)) (map[string]string, error) {
+	cache := loadHashCache(path)
+	hashes := make(map[string]string, len(states))
+
+	var stale []string
+	for rel, state := range states {
+		if cached, ok := cache[rel]; ok && cached.State == state {
+			hashes[rel] = cached.Hash
+		} else {
+			stale = append(stale, rel)
+		}
+	}
+
+	if len(stale) > 0 {
+		fresh, err := hash(stale)
+		if err != nil {
+			return nil, err
+		}
+		for rel, sum := range fresh {
+			hashes[rel] = sum
+			cache[rel] = hashedFile{State: states[rel], Hash: sum}
+		}
+	}
+
+	for rel := range cache {
+		if _, ok := states[rel]; !ok && inScope(rel, paths) {
+			delete(cache, rel)
+		}
+	}
+	if err := saveHashCache(path, cache); err != nil {
+		logWarn("failed to save hash cache: %s", err)
+	}
+
+	return hashes, nil
+}
+
+// statRemote returns the size and modification time of the remote files
+func statRemote(cfg *Config, dir string, paths []string) (map[string]fileState, error) {
+	targets := []string{"."}
+	if len(paths) > 0 {
+		targets = targets[:0]
+		for _, p := range paths {
+			targets = append(targets, shellQuote("./"+strings.TrimSuffix(p, "/")))
+		}
+	}
+	find := strings.Join(targets, " ")
+
+	output, err := runSSH(cfg, fmt.Sprintf(statRemoteScript, shellQuote(cfg.remoteDirPath(dir)), find, find))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(output) == "missing" {
+		return nil, ErrRemoteNotFound
+	}
+
+	return parseRemoteStates(output)
+}
+
+func parseRemoteStates(output string) (map[string]fileState, error) {
+	states := make(map[string]fileState)
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected remote stat line: %q", line)
+		}
+		size, err1 := strconv.ParseInt(fields[0], 10, 64)
+		mtime, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, fmt.Errorf("unexpected remote stat line: %q", line)
+		}
+		states[strings.TrimPrefix(fields[2], "./")] = fileState{Size: size, ModTime: mtime * int64(time.Second)}
+	}
+
+	return states, nil
+}
+
+func hashRemoteFiles(cfg *Config, dir string, rels []string) (map[string]string, error) {
+	var list strings.Builder
+	for _, rel := range rels {
+		list.WriteString("./" + rel + "\n")
+	}
+
+	output, err := runSSHInput(cfg, fmt.Sprintf(hashRemoteFilesScript, shellQuote(cfg.remoteDirPath(dir))), strings.NewReader(list.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHashList(output)
+}
+
+// verifyTransfer compares the hashes of both sides of the local after a
+// transfer, limited to paths if any are given
+func verifyTransfer(cfg *Config, local *Local, paths []string) ([]hashMismatch, error) {
+	root := transferRoot(local)
+	var excludes []string
+	if !local.Encrypt {
+		excludes = cfg.ExcludesForLocal(local)
+	}
+	if local.cipher != nil {
+		encrypted := make([]string, len(paths))
+		for i, p := range paths {
+			var err error
+			if encrypted[i], err = local.cipher.encryptPath(p); err != nil {
+				return nil, err
+			}
+		}
+		paths = encrypted
+	}
+
+	scopes := paths
+	if len(scopes) == 0 {
+		scopes = []string{""}
+	}
+	localStates := make(map[string]fileState)
+	for _, p := range scopes {
+		sub, err := snapshotTree(root, p, excludes, local.followsLinks())
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(localStates, sub)
+	}
+	maxSize := cfg.rsyncOptions(local).MaxSize
+	withoutLarger(localStates, maxSize)
+
+	localHashes, err := hashWithCache(hashCachePath(local, "local"), paths, localStates, func(rels []string) (map[string]string, error) {
+		hashes := make(map[string]string, len(rels))
+		for _, rel := range rels {
+			sum, err := hashFile(filepath.Join(root, filepath.FromSlash(rel)))
+			if err != nil {
+				return nil, err
+			}
+			hashes[rel] = sum
+		}
+		return hashes, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash local files: %w", err)
+	}
+
+	remoteStates, err := statRemote(cfg, local.RemoteDir(), paths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote files: %w", err)
+	}
+	for rel := range remoteStates {
+		if excludedPath(rel, excludes) {
+			delete(remoteStates, rel)
+		}
+	}
+	withoutLarger(remoteStates, maxSize)
+
+	remoteHashes, err := hashWithCache(hashCachePath(local, "remote"), paths, remoteStates, func(rels []string) (map[string]string, error) {
+		return hashRemoteFiles(cfg, local.RemoteDir(), rels)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash remote files: %w", err)
+	}
+
+	mismatches := compareHashes(localHashes, remoteHashes)
+	if local.cipher != nil {
+		for i := range mismatches {
+			if plain, err := local.cipher.decryptPath(mismatches[i].Path); err == nil {
+				mismatches[i].Path = plain
+			}
+		}
+	}
+
+	return mismatches, nil
+}
+
+// checkTransfer runs the post-transfer verification if enabled, recording the
+// outcome in the report; mismatches fail the command
+func checkTransfer(cfg *Config, local *Local, opts syncOptions, report *syncReport) error {
+	if !opts.Verify && !local.Verify {
+		return nil
+	}
+
+	logProgress("verifying transfer...")
+	mismatches, err := verifyTransfer(cfg, local, opts.Paths)
+	if err != nil {
+		return fmt.Errorf("failed to verify transfer: %w", err)
+	}
+	if !local.deletes() {
+		// append-only transfers leave the files only the receiving side has
+		onlyReceiver := "remote only"
+		if report.Command == "pull" {
+			onlyReceiver = "local only"
+		}
+		mismatches = withoutKind(mismatches, onlyReceiver)
+	}
+	verified := len(mismatches) == 0
+	report.Verified = &verified
+	report.Mismatches = mismatches
+
+	if len(mismatches) > 0 {
+		logWarn("%d file(s) don't match after the transfer:", len(mismatches))
+		for _, m := range mismatches {
+			fmt.Printf("  %-12s %s\n", m.Kind, m.Path)
+		}
+		return fmt.Errorf("verification failed for '%s'", local.Name)
+	}
+	logSuccess("verified, both sides are identical")
+
+	return nil
+}